@@ -3,3 +3,24 @@ module github.com/muller2002/http-file-server
 go 1.19
 
 require github.com/dastoori/higgs v1.1.0
+
+require (
+	github.com/BurntSushi/toml v1.2.1
+	github.com/GehirnInc/crypt v0.0.0-20230320061759-8cc1b52080c5
+	github.com/alecthomas/chroma/v2 v2.12.0
+	github.com/fsnotify/fsnotify v1.6.0
+	github.com/klauspost/compress v1.17.4
+	github.com/ulikunitz/xz v0.5.15
+	github.com/yuin/goldmark v1.6.0
+	golang.org/x/crypto v0.17.0
+	golang.org/x/image v0.14.0
+	golang.org/x/net v0.17.0
+	gopkg.in/yaml.v3 v3.0.1
+	lukechampine.com/blake3 v1.2.1
+)
+
+require (
+	github.com/dlclark/regexp2 v1.10.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+)
@@ -14,19 +14,39 @@ import (
 )
 
 const (
-	addrEnvVarName           = "ADDR"
-	allowUploadsEnvVarName   = "UPLOADS"
-	allowDeletesEnvVarName   = "DELETES"
-	allowCreatesEnvVarName   = "CREATES"
-	noAllowHiddenEnvVarName  = "NO_HIDDEN"
-	defaultAddr              = ":8080"
-	portEnvVarName           = "PORT"
-	quietEnvVarName          = "QUIET"
-	customTemplateEnvVarName = "TEMPLATES"
-	sslCertificateEnvVarName = "SSL_CERTIFICATE"
-	sslKeyEnvVarName         = "SSL_KEY"
-	userEnvVarName           = "USER"
-	passwdEnvName            = "PASSWD"
+	addrEnvVarName            = "ADDR"
+	allowUploadsEnvVarName    = "UPLOADS"
+	allowDeletesEnvVarName    = "DELETES"
+	allowCreatesEnvVarName    = "CREATES"
+	allowRenamesEnvVarName    = "RENAMES"
+	configEnvVarName          = "CONFIG"
+	maxUploadSizeEnvVarName   = "MAX_UPLOAD_SIZE"
+	noAllowHiddenEnvVarName   = "NO_HIDDEN"
+	defaultAddr               = ":8080"
+	htgroupEnvVarName         = "HTGROUP"
+	htpasswdEnvVarName        = "HTPASSWD"
+	portEnvVarName            = "PORT"
+	quietEnvVarName           = "QUIET"
+	customTemplateEnvVarName  = "TEMPLATES"
+	sslCertificateEnvVarName  = "SSL_CERTIFICATE"
+	sslKeyEnvVarName          = "SSL_KEY"
+	stateDirEnvVarName        = "STATE_DIR"
+	trashEnvVarName           = "TRASH"
+	trashRetentionEnvVarName  = "TRASH_RETENTION"
+	userEnvVarName            = "USER"
+	passwdEnvName             = "PASSWD"
+	webdavEnvVarName          = "WEBDAV"
+	indexEnvVarName           = "INDEX"
+	dirSizesEnvVarName        = "DIR_SIZES"
+	checksumFilesEnvVarName   = "CHECKSUM_FILES"
+	headerEnvVarName          = "HEADER"
+	footerEnvVarName          = "FOOTER"
+	extractMaxSizeEnvVarName  = "EXTRACT_MAX_SIZE"
+	extractMaxFilesEnvVarName = "EXTRACT_MAX_FILES"
+	conflictEnvVarName        = "CONFLICT"
+	maxFileSizeEnvVarName     = "MAX_FILE_SIZE"
+	quotaEnvVarName           = "QUOTA"
+	quotaFilesEnvVarName      = "QUOTA_FILES"
 )
 
 var (
@@ -34,16 +54,39 @@ var (
 	allowUploadsFlag   = os.Getenv(allowUploadsEnvVarName) == "true"
 	allowDeletesFlag   = os.Getenv(allowDeletesEnvVarName) == "true"
 	allowCreatesFlag   = os.Getenv(allowCreatesEnvVarName) == "true"
+	allowRenamesFlag   = os.Getenv(allowRenamesEnvVarName) == "true"
+	configFlag         = os.Getenv(configEnvVarName)
+	maxUploadSize, _   = strconv.ParseInt(os.Getenv(maxUploadSizeEnvVarName), 10, 64)
 	noAllowHiddenFlag  = os.Getenv(noAllowHiddenEnvVarName) == "true"
 	customTemplateFlag = os.Getenv(customTemplateEnvVarName)
+	htgroupFlag        = os.Getenv(htgroupEnvVarName)
+	htpasswdFlag       = os.Getenv(htpasswdEnvVarName)
 	portFlag64, _      = strconv.ParseInt(os.Getenv(portEnvVarName), 10, 64)
 	portFlag           = int(portFlag64)
 	quietFlag          = os.Getenv(quietEnvVarName) == "true"
 	routesFlag         server.Routes
 	sslCertificate     = os.Getenv(sslCertificateEnvVarName)
 	sslKey             = os.Getenv(sslKeyEnvVarName)
+	stateDirFlag       = os.Getenv(stateDirEnvVarName)
+	trashFlag          = os.Getenv(trashEnvVarName)
+	trashRetentionFlag = os.Getenv(trashRetentionEnvVarName)
 	userFlag           = os.Getenv(userEnvVarName)
 	passwdFlag         = os.Getenv(passwdEnvName)
+	webdavFlag         = os.Getenv(webdavEnvVarName) == "true"
+	indexFlag          = os.Getenv(indexEnvVarName) == "true"
+	dirSizesFlag       = os.Getenv(dirSizesEnvVarName) == "true"
+	checksumFilesFlag  = os.Getenv(checksumFilesEnvVarName) == "true"
+	headerFlag, _      = os.LookupEnv(headerEnvVarName)
+	footerFlag, _      = os.LookupEnv(footerEnvVarName)
+	extractMaxSize, _  = strconv.ParseInt(os.Getenv(extractMaxSizeEnvVarName), 10, 64)
+	extractMaxFiles, _ = strconv.Atoi(os.Getenv(extractMaxFilesEnvVarName))
+	conflictFlag       = os.Getenv(conflictEnvVarName)
+	maxFileSize, _     = strconv.ParseInt(os.Getenv(maxFileSizeEnvVarName), 10, 64)
+	quotaFlag, _       = strconv.ParseInt(os.Getenv(quotaEnvVarName), 10, 64)
+	quotaFilesFlag, _  = strconv.ParseInt(os.Getenv(quotaFilesEnvVarName), 10, 64)
+	userQuotas         map[string]server.Quota
+	headers            map[string]string
+	setFlags           = make(map[string]bool)
 )
 
 func init() {
@@ -52,6 +95,19 @@ func init() {
 	if addrFlag == "" {
 		addrFlag = defaultAddr
 	}
+	defaults := server.NewConfig()
+	if _, ok := os.LookupEnv(headerEnvVarName); !ok {
+		headerFlag = defaults.HeaderFlag
+	}
+	if _, ok := os.LookupEnv(footerEnvVarName); !ok {
+		footerFlag = defaults.FooterFlag
+	}
+	if _, ok := os.LookupEnv(extractMaxSizeEnvVarName); !ok {
+		extractMaxSize = defaults.ExtractMaxSizeFlag
+	}
+	if _, ok := os.LookupEnv(extractMaxFilesEnvVarName); !ok {
+		extractMaxFiles = defaults.ExtractMaxFilesFlag
+	}
 	flag.StringVar(&addrFlag, "addr", addrFlag, fmt.Sprintf("address to listen on (environment variable %q)", addrEnvVarName))
 	flag.StringVar(&addrFlag, "a", addrFlag, "(alias for -addr)")
 	flag.IntVar(&portFlag, "port", portFlag, fmt.Sprintf("port to listen on (overrides -addr port) (environment variable %q)", portEnvVarName))
@@ -64,20 +120,42 @@ func init() {
 	flag.BoolVar(&allowDeletesFlag, "d", allowDeletesFlag, "(alias for -deletes)")
 	flag.BoolVar(&allowCreatesFlag, "creates", allowCreatesFlag, fmt.Sprintf("allow creates folder (environment variable %q)", allowCreatesEnvVarName))
 	flag.BoolVar(&allowCreatesFlag, "c", allowCreatesFlag, "(alias for -creates)")
-	flag.BoolVar(&noAllowHiddenFlag, "nohidden", allowCreatesFlag, fmt.Sprintf("no allow hidden folders or files (environment variable %q)", noAllowHiddenEnvVarName))
-	flag.BoolVar(&noAllowHiddenFlag, "nh", allowCreatesFlag, "(alias for -nohidden)")
+	flag.BoolVar(&allowRenamesFlag, "renames", allowRenamesFlag, fmt.Sprintf("allow renaming and moving files and folders (environment variable %q)", allowRenamesEnvVarName))
+	flag.BoolVar(&allowRenamesFlag, "m", allowRenamesFlag, "(alias for -renames)")
+	flag.BoolVar(&noAllowHiddenFlag, "nohidden", noAllowHiddenFlag, fmt.Sprintf("no allow hidden folders or files (environment variable %q)", noAllowHiddenEnvVarName))
+	flag.BoolVar(&noAllowHiddenFlag, "nh", noAllowHiddenFlag, "(alias for -nohidden)")
+	flag.Int64Var(&maxUploadSize, "max-upload-size", maxUploadSize, fmt.Sprintf("maximum size of an upload request in bytes, 0 for no limit (environment variable %q)", maxUploadSizeEnvVarName))
+	flag.StringVar(&configFlag, "config", configFlag, fmt.Sprintf("path to a .yaml, .toml or .json config file with global and per-route settings.\n\tcommand line flags and environment variables override its global values, not those a route sets (environment variable %q)", configEnvVarName))
+	flag.BoolVar(&webdavFlag, "webdav", webdavFlag, fmt.Sprintf("serve WebDAV (PROPFIND, MKCOL, PUT, COPY, MOVE, LOCK/UNLOCK) on every route, writes follow -uploads/-deletes/-creates (environment variable %q)", webdavEnvVarName))
+	flag.BoolVar(&webdavFlag, "w", webdavFlag, "(alias for -webdav)")
+	flag.BoolVar(&dirSizesFlag, "dir-sizes", dirSizesFlag, fmt.Sprintf("show the recursive size of folders in listings, measured in the background (environment variable %q)", dirSizesEnvVarName))
+	flag.BoolVar(&checksumFilesFlag, "checksum-files", checksumFilesFlag, fmt.Sprintf("serve SHA256SUMS, SHA1SUMS, MD5SUMS and B3SUMS files with the checksums of the files of every folder (environment variable %q)", checksumFilesEnvVarName))
+	flag.BoolVar(&indexFlag, "index", indexFlag, fmt.Sprintf("keep an in-memory index of every route, updated by file system events, for listings and searches (environment variable %q)", indexEnvVarName))
+	flag.StringVar(&headerFlag, "header", headerFlag, fmt.Sprintf("comma separated file names, the first one found in a folder is shown above its listing, \"\" for none (environment variable %q)", headerEnvVarName))
+	flag.StringVar(&footerFlag, "footer", footerFlag, fmt.Sprintf("comma separated file names, the first one found in a folder is shown below its listing, \"\" for none (environment variable %q)", footerEnvVarName))
+	flag.Int64Var(&extractMaxSize, "extract-max-size", extractMaxSize, fmt.Sprintf("maximum number of bytes one upload and extract may unpack, 0 for no limit (environment variable %q)", extractMaxSizeEnvVarName))
+	flag.IntVar(&extractMaxFiles, "extract-max-files", extractMaxFiles, fmt.Sprintf("maximum number of entries one upload and extract may unpack, 0 for no limit (environment variable %q)", extractMaxFilesEnvVarName))
+	flag.StringVar(&conflictFlag, "conflict", conflictFlag, fmt.Sprintf("what uploads do with existing files: overwrite, reject, rename or versions (default overwrite) (environment variable %q)", conflictEnvVarName))
+	flag.Int64Var(&maxFileSize, "max-file-size", maxFileSize, fmt.Sprintf("maximum size of a single uploaded file in bytes, 0 for no limit (environment variable %q)", maxFileSizeEnvVarName))
+	flag.Int64Var(&quotaFlag, "quota", quotaFlag, fmt.Sprintf("maximum number of bytes stored in each route, 0 for no limit (environment variable %q)", quotaEnvVarName))
+	flag.Int64Var(&quotaFilesFlag, "quota-files", quotaFilesFlag, fmt.Sprintf("maximum number of files stored in each route, 0 for no limit (environment variable %q)", quotaFilesEnvVarName))
 	flag.Var(&routesFlag, "route", routesFlag.Help())
 	flag.Var(&routesFlag, "r", "(alias for -route)")
 	flag.StringVar(&sslCertificate, "ssl-cert", sslCertificate, fmt.Sprintf("path to SSL server certificate (environment variable %q)", sslCertificateEnvVarName))
 	flag.StringVar(&sslKey, "ssl-key", sslKey, fmt.Sprintf("path to SSL private key (environment variable %q)", sslKeyEnvVarName))
+	flag.StringVar(&stateDirFlag, "state-dir", stateDirFlag, fmt.Sprintf("directory for server working files such as partial resumable uploads (default: system temp dir) (environment variable %q)", stateDirEnvVarName))
+	flag.StringVar(&trashFlag, "trash", trashFlag, fmt.Sprintf("move deleted files to a per-route folder below this path instead of deleting them, listed at ROUTE?trash (environment variable %q)", trashEnvVarName))
+	flag.StringVar(&trashRetentionFlag, "trash-retention", trashRetentionFlag, fmt.Sprintf("how long deleted files stay in the trash, e.g. 72h or 30d, 0 keeps them (default 30d) (environment variable %q)", trashRetentionEnvVarName))
 	flag.StringVar(&customTemplateFlag, "templates", customTemplateFlag, fmt.Sprintf("path to custom Templates folder html.\n\tbase template = base.html, errors template = \"status_code\".html (401.html, 404.html, etc.).\n\t(environment variable %q)", customTemplateEnvVarName))
 	flag.StringVar(&customTemplateFlag, "t", customTemplateFlag, "(alias for -template)")
 	flag.StringVar(&userFlag, "user", userFlag, fmt.Sprintf("global user name for all routes (without auth) (environment variable %q).", userEnvVarName))
 	flag.StringVar(&passwdFlag, "passwd", passwdFlag, fmt.Sprintf("global password for all routes (without auth) (environment variable %q).", passwdEnvName))
+	flag.StringVar(&htpasswdFlag, "htpasswd", htpasswdFlag, fmt.Sprintf("htpasswd file (bcrypt, SHA-crypt, apr1 or {SHA} hashes) with the users of all routes (without auth) (environment variable %q).", htpasswdEnvVarName))
+	flag.StringVar(&htgroupFlag, "htgroup", htgroupFlag, fmt.Sprintf("htgroup file with \"group: user1 user2\" lines for the users/groups allow-lists of routes (environment variable %q).", htgroupEnvVarName))
 	flag.Parse()
-	if quietFlag {
-		log.SetOutput(ioutil.Discard)
-	}
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
 	for i := 0; i < flag.NArg(); i++ {
 		arg := flag.Arg(i)
 		err := routesFlag.Set(arg)
@@ -85,6 +163,86 @@ func init() {
 			log.Fatalf("%q: %v", arg, err)
 		}
 	}
+	if configFlag != "" {
+		applyConfigFile(configFlag)
+	}
+	if quietFlag {
+		log.SetOutput(ioutil.Discard)
+	}
+}
+
+// explicit reports whether a setting was given on the command line or in
+// the environment. Those take precedence over the config file.
+func explicit(envVarName string, flagNames ...string) bool {
+	if _, ok := os.LookupEnv(envVarName); ok {
+		return true
+	}
+	for _, name := range flagNames {
+		if setFlags[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// setFromFile sets dst to the value v of the config file, unless v is not
+// set or the setting was given as a flag or environment variable.
+func setFromFile[T any](dst *T, v *T, envVarName string, flagNames ...string) {
+	if v != nil && !explicit(envVarName, flagNames...) {
+		*dst = *v
+	}
+}
+
+func applyConfigFile(path string) {
+	file, err := server.LoadConfigFile(path)
+	if err != nil {
+		log.Fatalf("config %q: %v", path, err)
+	}
+	setFromFile(&addrFlag, file.Addr, addrEnvVarName, "addr", "a")
+	setFromFile(&portFlag, file.Port, portEnvVarName, "port", "p")
+	setFromFile(&quietFlag, file.Quiet, quietEnvVarName, "quiet", "q")
+	setFromFile(&allowUploadsFlag, file.AllowUploads, allowUploadsEnvVarName, "uploads", "u")
+	setFromFile(&allowDeletesFlag, file.AllowDeletes, allowDeletesEnvVarName, "deletes", "d")
+	setFromFile(&allowCreatesFlag, file.AllowCreates, allowCreatesEnvVarName, "creates", "c")
+	setFromFile(&allowRenamesFlag, file.AllowRenames, allowRenamesEnvVarName, "renames", "m")
+	setFromFile(&noAllowHiddenFlag, file.NoAllowHidden, noAllowHiddenEnvVarName, "nohidden", "nh")
+	setFromFile(&webdavFlag, file.WebDAV, webdavEnvVarName, "webdav", "w")
+	setFromFile(&indexFlag, file.Index, indexEnvVarName, "index")
+	setFromFile(&dirSizesFlag, file.DirSizes, dirSizesEnvVarName, "dir-sizes")
+	setFromFile(&checksumFilesFlag, file.ChecksumFiles, checksumFilesEnvVarName, "checksum-files")
+	setFromFile(&customTemplateFlag, file.Templates, customTemplateEnvVarName, "templates", "t")
+	setFromFile(&stateDirFlag, file.StateDir, stateDirEnvVarName, "state-dir")
+	setFromFile(&sslCertificate, file.SslCertificate, sslCertificateEnvVarName, "ssl-cert")
+	setFromFile(&sslKey, file.SslKey, sslKeyEnvVarName, "ssl-key")
+	// most shells set $USER, so only the flag overrides the user of the file
+	if file.User != nil && !setFlags["user"] {
+		userFlag = *file.User
+	}
+	setFromFile(&passwdFlag, file.Passwd, passwdEnvName, "passwd")
+	setFromFile(&htpasswdFlag, file.Htpasswd, htpasswdEnvVarName, "htpasswd")
+	setFromFile(&htgroupFlag, file.Htgroup, htgroupEnvVarName, "htgroup")
+	setFromFile(&trashFlag, file.Trash, trashEnvVarName, "trash")
+	setFromFile(&trashRetentionFlag, file.TrashRetention, trashRetentionEnvVarName, "trash-retention")
+	setFromFile(&headerFlag, file.Header, headerEnvVarName, "header")
+	setFromFile(&footerFlag, file.Footer, footerEnvVarName, "footer")
+	setFromFile(&conflictFlag, file.Conflict, conflictEnvVarName, "conflict")
+	setFromFile(&maxUploadSize, file.MaxUploadSize, maxUploadSizeEnvVarName, "max-upload-size")
+	setFromFile(&maxFileSize, file.MaxFileSize, maxFileSizeEnvVarName, "max-file-size")
+	setFromFile(&quotaFlag, file.Quota, quotaEnvVarName, "quota")
+	setFromFile(&quotaFilesFlag, file.QuotaFiles, quotaFilesEnvVarName, "quota-files")
+	userQuotas = file.UserQuotas
+	setFromFile(&extractMaxSize, file.ExtractMaxSize, extractMaxSizeEnvVarName, "extract-max-size")
+	setFromFile(&extractMaxFiles, file.ExtractMaxFiles, extractMaxFilesEnvVarName, "extract-max-files")
+	headers = file.Headers
+
+	// routes from the command line are added to (or replace) the routes of the file
+	routes := server.Routes{Values: file.Routes}
+	for _, route := range routesFlag.Values {
+		routes.Add(route)
+	}
+	routes.Texts = routesFlag.Texts
+	routesFlag = routes
+	log.Printf("loaded config %q", path)
 }
 
 func addr() (string, error) {
@@ -113,38 +271,72 @@ func addr() (string, error) {
 	}
 }
 
-func checkCustomTemplate() {
+func checkCustomTemplate(customTemplate string) string {
 	// check exist folder templates
 	osPathSeparator := string(filepath.Separator)
 
-	if customTemplateFlag != "" {
-		if stat, err := os.Stat(customTemplateFlag); os.IsNotExist(err) || stat.IsDir() == false {
-			log.Printf("Wrong path to folder with custom templates: %s\n", customTemplateFlag)
-			customTemplateFlag = ""
+	if customTemplate != "" {
+		if stat, err := os.Stat(customTemplate); os.IsNotExist(err) || stat.IsDir() == false {
+			log.Printf("Wrong path to folder with custom templates: %s\n", customTemplate)
+			customTemplate = ""
 		} else {
-			if string(customTemplateFlag[len(customTemplateFlag)-1]) == osPathSeparator {
-				customTemplateFlag = strings.TrimSuffix(customTemplateFlag, osPathSeparator)
+			if string(customTemplate[len(customTemplate)-1]) == osPathSeparator {
+				customTemplate = strings.TrimSuffix(customTemplate, osPathSeparator)
 			}
-			log.Printf("Added custom templates: %s", customTemplateFlag)
+			log.Printf("Added custom templates: %s", customTemplate)
 		}
 	}
+	return customTemplate
 }
 
 func newConfig() server.Config {
-	checkCustomTemplate()
+	customTemplateFlag = checkCustomTemplate(customTemplateFlag)
+	for i := range routesFlag.Values {
+		routesFlag.Values[i].Templates = checkCustomTemplate(routesFlag.Values[i].Templates)
+	}
 
 	cfg := server.NewConfig()
 	cfg.AllowCreatesFlag = allowCreatesFlag
 	cfg.AllowDeletesFlag = allowDeletesFlag
+	cfg.AllowRenamesFlag = allowRenamesFlag
 	cfg.AllowCreatesFlag = allowCreatesFlag
 	cfg.AllowUploadsFlag = allowUploadsFlag
 	cfg.CustomTemplateFlag = customTemplateFlag
+	cfg.HeadersFlag = headers
+	cfg.HtgroupFlag = htgroupFlag
+	cfg.HtpasswdFlag = htpasswdFlag
+	cfg.MaxUploadSizeFlag = maxUploadSize
 	cfg.NoAllowHiddenFlag = noAllowHiddenFlag
 	cfg.PasswdFlag = passwdFlag
 	cfg.RootRoute = "/"
+	cfg.Routes = routesFlag
 	cfg.SslCertificate = sslCertificate
 	cfg.SslKey = sslKey
+	if stateDirFlag != "" {
+		cfg.StateDirFlag = stateDirFlag
+	}
+	cfg.TrashFlag = trashFlag
+	if trashRetentionFlag != "" {
+		retention, err := server.ParseDuration(trashRetentionFlag)
+		if err != nil {
+			log.Fatalf("trash-retention: %v", err)
+		}
+		cfg.TrashRetentionFlag = retention
+	}
 	cfg.UserFlag = userFlag
+	cfg.WebDAVFlag = webdavFlag
+	cfg.IndexFlag = indexFlag
+	cfg.DirSizesFlag = dirSizesFlag
+	cfg.ChecksumFilesFlag = checksumFilesFlag
+	cfg.HeaderFlag = headerFlag
+	cfg.FooterFlag = footerFlag
+	cfg.ExtractMaxSizeFlag = extractMaxSize
+	cfg.ExtractMaxFilesFlag = extractMaxFiles
+	cfg.ConflictFlag = conflictFlag
+	cfg.MaxFileSizeFlag = maxFileSize
+	cfg.QuotaFlag = quotaFlag
+	cfg.QuotaFilesFlag = quotaFilesFlag
+	cfg.UserQuotasFlag = userQuotas
 
 	return cfg
 }
@@ -33,18 +33,33 @@ var template401 = []byte(`
 </html>`)
 
 func BasicAuth(handler http.HandlerFunc, username, password, customTemplate string) http.HandlerFunc {
+	return basicAuth(handler, func(user, pass string) bool {
+		return subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1 && subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+	}, customTemplate)
+}
+
+// HtpasswdAuth accepts the users of htpasswd that are listed in users or
+// belong to one of groups. Empty lists accept every user of the file.
+func HtpasswdAuth(handler http.HandlerFunc, htpasswd *Htpasswd, users, groups []string, customTemplate string) http.HandlerFunc {
+	return basicAuth(handler, func(user, pass string) bool {
+		return htpasswd.Authenticate(user, pass) && htpasswd.Allowed(user, users, groups)
+	}, customTemplate)
+}
+
+func basicAuth(handler http.HandlerFunc, check func(user, pass string) bool, customTemplate string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user, pass, ok := r.BasicAuth()
-		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 || subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+		if !ok || !check(user, pass) {
 			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
 			w.WriteHeader(401)
+			body := template401
 			if customTemplate != "" {
 				p := customTemplate + osPathSeparator + "errors" + osPathSeparator + "401.html"
-				template401, _ = os.ReadFile(p)
+				body, _ = os.ReadFile(p)
 			}
-			w.Write(template401)
+			w.Write(body)
 			return
 		}
-		handler(w, r)
+		handler(w, withUser(r, user))
 	}
 }
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+const (
+	checksumKey      = "checksum"
+	checksumCacheDir = "checksums"
+
+	checksumSHA256 = "sha256"
+	checksumSHA1   = "sha1"
+	checksumMD5    = "md5"
+	checksumBLAKE3 = "blake3"
+)
+
+var (
+	// checksumFiles maps the names of the virtual checksum files of a
+	// folder to their algorithm
+	checksumFiles = map[string]string{
+		"SHA256SUMS": checksumSHA256,
+		"SHA1SUMS":   checksumSHA1,
+		"MD5SUMS":    checksumMD5,
+		"B3SUMS":     checksumBLAKE3,
+	}
+
+	// checksumWorkers limits the number of files hashed at the same time
+	checksumWorkers = make(chan struct{}, runtime.NumCPU())
+
+	errUnknownChecksum = fmt.Errorf("unknown checksum, want %s, %s, %s or %s", checksumSHA256, checksumSHA1, checksumMD5, checksumBLAKE3)
+)
+
+// newChecksum returns a hash of the algorithm alg, or nil.
+func newChecksum(alg string) hash.Hash {
+	switch alg {
+	case checksumSHA256:
+		return sha256.New()
+	case checksumSHA1:
+		return sha1.New()
+	case checksumMD5:
+		return md5.New()
+	case checksumBLAKE3:
+		return blake3.New(32, nil)
+	}
+	return nil
+}
+
+// checksumPath returns the cache file of the checksum of osPath. Modified
+// or replaced files get a new key.
+func (f *FileHandler) checksumPath(osPath string, info os.FileInfo, alg string) string {
+	key := fmt.Sprintf("%s\x00%d\x00%d\x00%s", osPath, info.ModTime().UnixNano(), info.Size(), alg)
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(f.stateDir, checksumCacheDir, hex.EncodeToString(sum[:])+"."+alg)
+}
+
+// cacheChecksum stores the hex checksum of the file at osPath as it is now.
+func (f *FileHandler) cacheChecksum(osPath string, info os.FileInfo, alg, sum string) error {
+	dst := f.checksumPath(osPath, info, alg)
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".checksum-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(sum); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// cacheUploadChecksums stores the checksums computed while a file was
+// uploaded, so they need not be computed again on download.
+func (f *FileHandler) cacheUploadChecksums(osPath string, h *hasher) {
+	info, err := os.Stat(osPath)
+	if err != nil {
+		return
+	}
+	for alg, sum := range map[string][]byte{checksumSHA256: h.sum(digestSHA256), checksumMD5: h.sum(digestMD5)} {
+		if err := f.cacheChecksum(osPath, info, alg, hex.EncodeToString(sum)); err != nil {
+			log.Println("checksum:", err)
+		}
+	}
+}
+
+// fileChecksum returns the hex checksum of the file at osPath, from the
+// cache if the file was hashed before.
+func (f *FileHandler) fileChecksum(osPath string, info os.FileInfo, alg string) (string, error) {
+	h := newChecksum(alg)
+	if h == nil {
+		return "", errUnknownChecksum
+	}
+	if cached, err := os.ReadFile(f.checksumPath(osPath, info, alg)); err == nil && len(cached) == hex.EncodedLen(h.Size()) {
+		return string(cached), nil
+	}
+	file, err := os.Open(osPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	checksumWorkers <- struct{}{}
+	_, err = io.Copy(h, file)
+	<-checksumWorkers
+	if err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	// files that changed while they were hashed are not cached
+	if now, err := file.Stat(); err == nil && now.Size() == info.Size() && now.ModTime().Equal(info.ModTime()) {
+		if err := f.cacheChecksum(osPath, info, alg, sum); err != nil {
+			log.Println("checksum:", err)
+		}
+	}
+	return sum, nil
+}
+
+// checksumLine formats a checksum like sha256sum does, escaping names with
+// backslashes and newlines.
+func checksumLine(sum, name string) string {
+	if strings.ContainsAny(name, "\\\n\r") {
+		name = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r").Replace(name)
+		sum = "\\" + sum
+	}
+	return sum + "  " + name + "\n"
+}
+
+type checksumReport struct {
+	Version   int    `json:"version"`
+	Path      string `json:"path"`
+	Algorithm string `json:"algorithm"`
+	Checksum  string `json:"checksum"`
+	Size      int64  `json:"size"`
+}
+
+// serveChecksum answers GET ?checksum=sha256|sha1|md5|blake3 with the
+// checksum of a file in the format of sha256sum, or with the checksums of
+// the files of a folder.
+func (f *FileHandler) serveChecksum(w http.ResponseWriter, r *http.Request, osPath string, info os.FileInfo) error {
+	alg := strings.ToLower(r.URL.Query().Get(checksumKey))
+	if newChecksum(alg) == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(errUnknownChecksum.Error()))
+		return nil
+	}
+	if info.IsDir() {
+		return f.serveChecksumFile(w, r, osPath, alg)
+	}
+	sum, err := f.fileChecksum(osPath, info, alg)
+	if err != nil {
+		_ = f.serveStatus(w, r, http.StatusInternalServerError)
+		return err
+	}
+	if wantsJSON(r) {
+		return writeJSON(w, http.StatusOK, checksumReport{
+			Version:   listingSchemaVersion,
+			Path:      r.URL.Path,
+			Algorithm: alg,
+			Checksum:  sum,
+			Size:      info.Size(),
+		})
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err = io.WriteString(w, checksumLine(sum, info.Name()))
+	return err
+}
+
+// isChecksumFile reports whether osPath names a virtual checksum file, a
+// SHA256SUMS or the like in a folder that has no such file.
+func (f *FileHandler) isChecksumFile(osPath string) bool {
+	if !f.checksumFiles {
+		return false
+	}
+	if _, ok := checksumFiles[filepath.Base(osPath)]; !ok {
+		return false
+	}
+	info, err := os.Stat(filepath.Dir(osPath))
+	return err == nil && info.IsDir()
+}
+
+// serveChecksumFile answers with the checksums of the files in the folder
+// dir, one line each as sha256sum writes them. Folders and the files the
+// route hides are left out.
+func (f *FileHandler) serveChecksumFile(w http.ResponseWriter, r *http.Request, dir, alg string) error {
+	files, err := f.readDir(dir)
+	if err != nil {
+		_ = f.serveStatus(w, r, http.StatusInternalServerError)
+		return err
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	for _, info := range files {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		sum, err := f.fileChecksum(filepath.Join(dir, info.Name()), info, alg)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			// the status is sent, all that is left is to leave the file out
+			log.Println("checksum:", err)
+			continue
+		}
+		if _, err := io.WriteString(w, checksumLine(sum, info.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
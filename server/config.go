@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// FileConfig is the content of the -config file. Keys are named after the
+// command line flags; values that are not set keep the flag defaults.
+type FileConfig struct {
+	Addr            *string           `json:"addr" yaml:"addr" toml:"addr"`
+	Port            *int              `json:"port" yaml:"port" toml:"port"`
+	Quiet           *bool             `json:"quiet" yaml:"quiet" toml:"quiet"`
+	AllowUploads    *bool             `json:"uploads" yaml:"uploads" toml:"uploads"`
+	AllowDeletes    *bool             `json:"deletes" yaml:"deletes" toml:"deletes"`
+	AllowCreates    *bool             `json:"creates" yaml:"creates" toml:"creates"`
+	AllowRenames    *bool             `json:"renames" yaml:"renames" toml:"renames"`
+	NoAllowHidden   *bool             `json:"nohidden" yaml:"nohidden" toml:"nohidden"`
+	WebDAV          *bool             `json:"webdav" yaml:"webdav" toml:"webdav"`
+	Index           *bool             `json:"index" yaml:"index" toml:"index"`
+	DirSizes        *bool             `json:"dir-sizes" yaml:"dir-sizes" toml:"dir-sizes"`
+	ChecksumFiles   *bool             `json:"checksum-files" yaml:"checksum-files" toml:"checksum-files"`
+	Header          *string           `json:"header" yaml:"header" toml:"header"`
+	Footer          *string           `json:"footer" yaml:"footer" toml:"footer"`
+	Conflict        *string           `json:"conflict" yaml:"conflict" toml:"conflict"`
+	Templates       *string           `json:"templates" yaml:"templates" toml:"templates"`
+	StateDir        *string           `json:"state-dir" yaml:"state-dir" toml:"state-dir"`
+	SslCertificate  *string           `json:"ssl-cert" yaml:"ssl-cert" toml:"ssl-cert"`
+	SslKey          *string           `json:"ssl-key" yaml:"ssl-key" toml:"ssl-key"`
+	User            *string           `json:"user" yaml:"user" toml:"user"`
+	Passwd          *string           `json:"passwd" yaml:"passwd" toml:"passwd"`
+	Htpasswd        *string           `json:"htpasswd" yaml:"htpasswd" toml:"htpasswd"`
+	Htgroup         *string           `json:"htgroup" yaml:"htgroup" toml:"htgroup"`
+	MaxUploadSize   *int64            `json:"max-upload-size" yaml:"max-upload-size" toml:"max-upload-size"`
+	MaxFileSize     *int64            `json:"max-file-size" yaml:"max-file-size" toml:"max-file-size"`
+	Quota           *int64            `json:"quota" yaml:"quota" toml:"quota"`
+	QuotaFiles      *int64            `json:"quota-files" yaml:"quota-files" toml:"quota-files"`
+	UserQuotas      map[string]Quota  `json:"user-quotas" yaml:"user-quotas" toml:"user-quotas"`
+	ExtractMaxSize  *int64            `json:"extract-max-size" yaml:"extract-max-size" toml:"extract-max-size"`
+	ExtractMaxFiles *int              `json:"extract-max-files" yaml:"extract-max-files" toml:"extract-max-files"`
+	Trash           *string           `json:"trash" yaml:"trash" toml:"trash"`
+	TrashRetention  *string           `json:"trash-retention" yaml:"trash-retention" toml:"trash-retention"`
+	Headers         map[string]string `json:"headers" yaml:"headers" toml:"headers"`
+	Routes          []Route           `json:"routes" yaml:"routes" toml:"routes"`
+}
+
+// LoadConfigFile reads a YAML, TOML or JSON config file, picked by extension.
+// Relative paths in the file are resolved against the directory of the file.
+func LoadConfigFile(path string) (FileConfig, error) {
+	var cfg FileConfig
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &cfg)
+	case ".toml":
+		err = toml.Unmarshal(b, &cfg)
+	case ".json":
+		err = json.Unmarshal(b, &cfg)
+	default:
+		return cfg, fmt.Errorf("unknown config format %q, use .yaml, .toml or .json", filepath.Ext(path))
+	}
+	if err != nil {
+		return cfg, err
+	}
+
+	base, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return cfg, err
+	}
+	abs := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(base, p)
+	}
+	for _, p := range []*string{cfg.Templates, cfg.StateDir, cfg.SslCertificate, cfg.SslKey, cfg.Htpasswd, cfg.Htgroup, cfg.Trash} {
+		if p != nil {
+			*p = abs(*p)
+		}
+	}
+	for i := range cfg.Routes {
+		route := &cfg.Routes[i]
+		if route.Path == "" {
+			return cfg, fmt.Errorf("route %d: path must not be empty", i+1)
+		}
+		route.Path = abs(route.Path)
+		route.Templates = abs(route.Templates)
+		route.Trash = abs(route.Trash)
+		if route.Route == "" {
+			route.Route = filepath.Base(route.Path)
+		}
+		route.Route = normalizeRoute(route.Route)
+	}
+	return cfg, nil
+}
+
+func boolOr(v *bool, def bool) bool {
+	if v != nil {
+		return *v
+	}
+	return def
+}
+
+func stringOr(v *string, def string) string {
+	if v != nil {
+		return *v
+	}
+	return def
+}
+
+func int64Or(v *int64, def int64) int64 {
+	if v != nil {
+		return *v
+	}
+	return def
+}
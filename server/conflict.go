@@ -0,0 +1,159 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// conflictOverwrite replaces existing files, the default
+	conflictOverwrite = "overwrite"
+	// conflictReject refuses uploads of files that exist
+	conflictReject = "reject"
+	// conflictRename saves the upload as "name (1).ext"
+	conflictRename = "rename"
+	// conflictVersions moves the replaced file to a .versions folder
+	conflictVersions = "versions"
+
+	versionsDirName = ".versions"
+	// renameAttempts is the highest number tried for conflictRename
+	renameAttempts = 10000
+)
+
+// ParseConflict checks the name of an upload conflict policy.
+func ParseConflict(s string) (string, error) {
+	switch s {
+	case "":
+		return conflictOverwrite, nil
+	case conflictOverwrite, conflictReject, conflictRename, conflictVersions:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q, want %s, %s, %s or %s", s, conflictOverwrite, conflictReject, conflictRename, conflictVersions)
+}
+
+// splitExt splits a file name into stem and extension, keeping the .tar
+// of compressed tar files in the extension.
+func splitExt(name string) (string, string) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if stem == "" {
+		return name, ""
+	}
+	if strings.HasSuffix(strings.ToLower(stem), ".tar") {
+		ext = stem[len(stem)-4:] + ext
+		stem = stem[:len(stem)-4]
+	}
+	return stem, ext
+}
+
+// isWorkingFile reports whether name is one of the files the server keeps
+// next to the files it serves: a .versions folder, the staging file of an
+// upload or the staging folder of a copy.
+func isWorkingFile(name string) bool {
+	return name == versionsDirName ||
+		strings.HasPrefix(name, ".") && (strings.HasSuffix(name, ".tmp") || strings.Contains(name, ".copy-"))
+}
+
+// createTemp creates a new hidden file in the folder of dst for an upload
+// to dst.
+func createTemp(dst string) (*os.File, error) {
+	return os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp")
+}
+
+// writeTemp writes r to a new hidden file in the folder of dst, to be moved
+// into place with place.
+func writeTemp(dst string, perm os.FileMode, r io.Reader) (string, int64, error) {
+	tmp, err := createTemp(dst)
+	if err != nil {
+		return "", 0, err
+	}
+	n, err := io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", n, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", n, err
+	}
+	return tmp.Name(), n, nil
+}
+
+// renameNoReplace renames src to dst unless dst exists. Hard links make
+// this atomic; file systems without them get a check before the rename.
+func renameNoReplace(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return os.Remove(src)
+	} else if os.IsExist(err) {
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: os.ErrExist}
+	}
+	return os.Rename(src, dst)
+}
+
+// keepVersion moves the file at p to the .versions folder next to it,
+// named after the time it was replaced.
+func keepVersion(p string) error {
+	if _, err := os.Lstat(p); os.IsNotExist(err) {
+		return nil
+	}
+	dir := filepath.Join(filepath.Dir(p), versionsDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	stem, ext := splitExt(filepath.Base(p))
+	name := fmt.Sprintf("%s (%s)%s", stem, time.Now().UTC().Format("2006-01-02 150405.000"), ext)
+	return os.Rename(p, filepath.Join(dir, name))
+}
+
+// place moves the finished upload tmp to dst, or next to it, by the
+// conflict policy of the route. It returns the path the file ended up at.
+func (f *FileHandler) place(tmp, dst string) (string, error) {
+	if info, err := os.Lstat(dst); err == nil && !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%w: %q exists and is not a file", errInvalidPath, filepath.Base(dst))
+	}
+	switch f.conflict {
+	case conflictReject:
+		err := renameNoReplace(tmp, dst)
+		if os.IsExist(err) {
+			return "", fmt.Errorf("%w: %q", errExists, filepath.Base(dst))
+		} else if err != nil {
+			return "", err
+		}
+		return dst, nil
+	case conflictRename:
+		stem, ext := splitExt(filepath.Base(dst))
+		for i := 0; i < renameAttempts; i++ {
+			p := dst
+			if i > 0 {
+				p = filepath.Join(filepath.Dir(dst), fmt.Sprintf("%s (%d)%s", stem, i, ext))
+			}
+			err := renameNoReplace(tmp, p)
+			if err == nil {
+				return p, nil
+			} else if !os.IsExist(err) {
+				return "", err
+			}
+		}
+		return "", fmt.Errorf("%w: %q", errExists, filepath.Base(dst))
+	case conflictVersions:
+		if err := keepVersion(dst); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	copyKey = "copy"
+	jobKey  = "job"
+
+	// copyWait is how long a copy request waits before it answers with a job
+	copyWait = 2 * time.Second
+	// jobRetention is how long finished jobs can still be queried
+	jobRetention = time.Hour
+)
+
+// copyJob is a server-side copy running in the background.
+type copyJob struct {
+	ID          string `json:"id"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	TotalBytes  int64  `json:"total_bytes"`
+	CopiedBytes int64  `json:"copied_bytes"`
+	TotalFiles  int64  `json:"total_files"`
+	CopiedFiles int64  `json:"copied_files"`
+	Done        bool   `json:"done"`
+	Error       string `json:"error,omitempty"`
+
+	route string
+	done  chan struct{}
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = make(map[string]*copyJob)
+)
+
+func addJob(job *copyJob) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	jobs[job.ID] = job
+}
+
+// snapshot returns a copy of the job that is safe to encode.
+func (j *copyJob) snapshot() copyJob {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return copyJob{
+		ID:          j.ID,
+		Source:      j.Source,
+		Destination: j.Destination,
+		TotalBytes:  j.TotalBytes,
+		CopiedBytes: atomic.LoadInt64(&j.CopiedBytes),
+		TotalFiles:  j.TotalFiles,
+		CopiedFiles: atomic.LoadInt64(&j.CopiedFiles),
+		Done:        j.Done,
+		Error:       j.Error,
+	}
+}
+
+func (j *copyJob) finish(err error) {
+	jobsMu.Lock()
+	j.Done = true
+	if err != nil {
+		j.Error = err.Error()
+	}
+	jobsMu.Unlock()
+	close(j.done)
+	time.AfterFunc(jobRetention, func() {
+		jobsMu.Lock()
+		delete(jobs, j.ID)
+		jobsMu.Unlock()
+	})
+}
+
+// progressWriter counts the bytes written by a copy.
+type progressWriter struct {
+	io.Writer
+	n *int64
+}
+
+func (p progressWriter) Write(b []byte) (int, error) {
+	n, err := p.Writer.Write(b)
+	atomic.AddInt64(p.n, int64(n))
+	return n, err
+}
+
+// copyTree copies src to dst recursively, keeping modes and modification
+// times. Symbolic links are copied as links.
+func copyTree(src, dst string, job *copyJob) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.IsDir():
+			return os.Mkdir(target, info.Mode().Perm()|0700)
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		if err := copyFile(p, target, info, &job.CopiedBytes); err != nil {
+			return err
+		}
+		atomic.AddInt64(&job.CopiedFiles, 1)
+		return nil
+	})
+}
+
+func copyFile(src, dst string, info os.FileInfo, copied *int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(progressWriter{Writer: out, n: copied}, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// treeSize returns the size and number of regular files below p.
+func treeSize(p string) (size, files int64, err error) {
+	err = filepath.Walk(p, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+			files++
+		}
+		return nil
+	})
+	return size, files, err
+}
+
+// runCopy copies into a hidden temporary name next to dst, so dst only
+// appears once the copy is complete.
+func runCopy(src, dst string, job *copyJob) {
+	tmp := filepath.Join(filepath.Dir(dst), fmt.Sprintf(".%s.copy-%s", filepath.Base(dst), job.ID))
+	err := copyTree(src, tmp, job)
+	if err == nil {
+		if _, statErr := os.Lstat(dst); statErr == nil {
+			err = errExists
+		} else {
+			err = os.Rename(tmp, dst)
+		}
+	}
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+		log.Printf("copy %q to %q: %v", src, dst, err)
+	} else {
+		log.Printf("copied %q to %q", src, dst)
+	}
+	job.finish(err)
+}
+
+func (f *FileHandler) jobURL(id string) string {
+	u := url.URL{Path: f.route, RawQuery: url.Values{jobKey: {id}}.Encode()}
+	return u.String()
+}
+
+// serveCopy handles POST ?copy (form field "to") and COPY (Destination
+// header). Copies that take longer than copyWait continue in the
+// background and are answered with 202 and the URL of the job.
+func (f *FileHandler) serveCopy(w http.ResponseWriter, r *http.Request, osPath string, info os.FileInfo) error {
+	var dst string
+	var err error
+	if r.Method == "COPY" {
+		dst, err = f.headerDestination(r)
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return f.serveStatus(w, r, http.StatusBadRequest)
+		}
+		dst, err = f.destination(osPath, r.FormValue(toKey))
+	}
+	switch {
+	case errors.Is(err, errOutsideRoute) || !withinNoLinks(f.path, osPath):
+		return f.serveStatus(w, r, http.StatusForbidden)
+	case err != nil:
+		return f.serveStatus(w, r, http.StatusBadRequest)
+	}
+	if perms := f.permissions(r, dst); !perms.upload || info.IsDir() && !perms.create {
+		return f.serveStatus(w, r, http.StatusForbidden)
+	}
+	if err := checkMove(osPath, dst); errors.Is(err, errExists) {
+		return f.serveStatus(w, r, http.StatusConflict)
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return err
+	}
+
+	id, err := newID()
+	if err != nil {
+		_ = f.serveStatus(w, r, http.StatusInternalServerError)
+		return err
+	}
+	relSrc, _ := filepath.Rel(f.path, osPath)
+	relDst, _ := filepath.Rel(f.path, dst)
+	job := &copyJob{
+		ID:          id,
+		Source:      path.Join(f.route, filepath.ToSlash(relSrc)),
+		Destination: path.Join(f.route, filepath.ToSlash(relDst)),
+		route:       f.route,
+		done:        make(chan struct{}),
+	}
+	job.TotalBytes, job.TotalFiles, err = treeSize(osPath)
+	if err != nil {
+		_ = f.serveStatus(w, r, http.StatusInternalServerError)
+		return err
+	}
+	if err := f.checkCopy(r, job.TotalBytes, job.TotalFiles); err != nil {
+		f.serveTooLarge(w, r, err)
+		return err
+	}
+	addJob(job)
+	go runCopy(osPath, dst, job)
+
+	select {
+	case <-job.done:
+	case <-time.After(copyWait):
+		w.Header().Set("Location", f.jobURL(id))
+		return writeJSON(w, http.StatusAccepted, job.snapshot())
+	}
+	if snapshot := job.snapshot(); snapshot.Error != "" {
+		_ = f.serveStatus(w, r, http.StatusInternalServerError)
+		return errors.New(snapshot.Error)
+	}
+	if r.Method == "COPY" {
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	}
+	if wantsJSON(r) {
+		return writeJSON(w, http.StatusOK, job.snapshot())
+	}
+	w.Header().Set("Location", path.Dir(job.Destination)+"/")
+	w.WriteHeader(http.StatusSeeOther)
+	return nil
+}
+
+// serveJob reports the progress of a copy job as JSON.
+func (f *FileHandler) serveJob(w http.ResponseWriter, r *http.Request) error {
+	jobsMu.Lock()
+	job, ok := jobs[r.URL.Query().Get(jobKey)]
+	jobsMu.Unlock()
+	if !ok || job.route != f.route {
+		return f.serveStatus(w, r, http.StatusNotFound)
+	}
+	return writeJSON(w, http.StatusOK, job.snapshot())
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+const (
+	digestMD5    = "md5"
+	digestSHA256 = "sha-256"
+
+	// md5Field and sha256Field are the form fields with the checksum of
+	// the file part that follows them
+	md5Field    = "md5"
+	sha256Field = "sha256"
+	// maxDigestField bounds the size of a checksum form field
+	maxDigestField = 1 << 10
+)
+
+var (
+	errDigest        = errors.New("checksum mismatch")
+	errInvalidDigest = errors.New("invalid checksum")
+)
+
+// digests are checksums sent along with an upload, by algorithm.
+type digests map[string][]byte
+
+// set adds a checksum, refusing a second different one for the same
+// algorithm.
+func (d digests) set(alg string, sum []byte) error {
+	if old, ok := d[alg]; ok && !bytes.Equal(old, sum) {
+		return fmt.Errorf("%w: conflicting %s checksums", errInvalidDigest, alg)
+	}
+	d[alg] = sum
+	return nil
+}
+
+// merge returns the checksums of d and other.
+func (d digests) merge(other digests) (digests, error) {
+	out := digests{}
+	for _, m := range []digests{d, other} {
+		for alg, sum := range m {
+			if err := out.set(alg, sum); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out, nil
+}
+
+// decodeDigest decodes a checksum of alg given in base64 or, for form
+// fields, hex.
+func decodeDigest(alg, s string, allowHex bool) ([]byte, error) {
+	size := md5.Size
+	if alg == digestSHA256 {
+		size = sha256.Size
+	}
+	s = strings.TrimSpace(s)
+	if allowHex && len(s) == hex.EncodedLen(size) {
+		if sum, err := hex.DecodeString(s); err == nil {
+			return sum, nil
+		}
+	}
+	sum, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(sum) != size {
+		return nil, fmt.Errorf("%w: %s %q", errInvalidDigest, alg, s)
+	}
+	return sum, nil
+}
+
+// parseDigests reads the checksums of the headers Content-MD5, Digest
+// (RFC 3230) and Repr-Digest (RFC 9530). Algorithms other than MD5 and
+// SHA-256 are ignored.
+func parseDigests(h textproto.MIMEHeader) (digests, error) {
+	d := digests{}
+	if v := h.Get("Content-MD5"); v != "" {
+		sum, err := decodeDigest(digestMD5, v, false)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.set(digestMD5, sum); err != nil {
+			return nil, err
+		}
+	}
+	for _, header := range []string{"Digest", "Repr-Digest"} {
+		structured := header == "Repr-Digest"
+		for _, v := range h.Values(header) {
+			for _, item := range strings.Split(v, ",") {
+				alg, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+				alg = strings.ToLower(strings.TrimSpace(alg))
+				if !ok || (alg != digestMD5 && alg != digestSHA256) {
+					continue
+				}
+				if structured {
+					// structured fields wrap byte sequences in colons
+					value = strings.TrimSpace(value)
+					if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+						return nil, fmt.Errorf("%w: %s %q", errInvalidDigest, alg, value)
+					}
+					value = value[1 : len(value)-1]
+				}
+				sum, err := decodeDigest(alg, value, false)
+				if err != nil {
+					return nil, err
+				}
+				if err := d.set(alg, sum); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return d, nil
+}
+
+// readDigestField reads a md5 or sha256 form field into d.
+func readDigestField(d digests, name string, r io.Reader) error {
+	alg := digestMD5
+	if name == sha256Field {
+		alg = digestSHA256
+	}
+	value, err := io.ReadAll(io.LimitReader(r, maxDigestField))
+	if err != nil {
+		return err
+	}
+	sum, err := decodeDigest(alg, string(value), true)
+	if err != nil {
+		return err
+	}
+	return d.set(alg, sum)
+}
+
+// hasher computes the checksums of what is written to it.
+type hasher struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func newHasher() *hasher {
+	return &hasher{md5: md5.New(), sha256: sha256.New()}
+}
+
+func (h *hasher) Write(p []byte) (int, error) {
+	h.md5.Write(p)
+	h.sha256.Write(p)
+	return len(p), nil
+}
+
+func (h *hasher) sum(alg string) []byte {
+	if alg == digestSHA256 {
+		return h.sha256.Sum(nil)
+	}
+	return h.md5.Sum(nil)
+}
+
+// verify compares the checksums with the expected ones.
+func (h *hasher) verify(want digests) error {
+	for _, alg := range []string{digestSHA256, digestMD5} {
+		expected, ok := want[alg]
+		if !ok {
+			continue
+		}
+		if got := h.sum(alg); !bytes.Equal(got, expected) {
+			return fmt.Errorf("%w: %s is %x, expected %x", errDigest, alg, got, expected)
+		}
+	}
+	return nil
+}
+
+// reprDigest formats the SHA-256 checksum as a Repr-Digest header.
+func (h *hasher) reprDigest() string {
+	return digestSHA256 + "=:" + base64.StdEncoding.EncodeToString(h.sum(digestSHA256)) + ":"
+}
+
+// uploadedFile reports a saved upload with its checksums, so clients can
+// confirm what arrived.
+type uploadedFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256"`
+}
+
+type uploadReport struct {
+	Version int            `json:"version"`
+	Files   []uploadedFile `json:"files"`
+}
+
+// isDigestError reports whether err is about the checksums of an upload.
+func isDigestError(err error) bool {
+	return errors.Is(err, errDigest) || errors.Is(err, errInvalidDigest)
+}
+
+// serveDigestError answers an upload whose checksums did not match.
+func serveDigestError(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusBadRequest)
+	_, _ = w.Write([]byte(err.Error()))
+}
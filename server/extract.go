@@ -0,0 +1,337 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	extractKey        = "extract"
+	extractStagingDir = "extract"
+
+	archiveZip    = "zip"
+	archiveTar    = "tar"
+	archiveTarGz  = "tar.gz"
+	archiveTarZst = "tar.zst"
+
+	// extractMaxWindow bounds the memory a zstd stream may ask for
+	extractMaxWindow = 128 << 20
+	// extractZipSlack is what a zip may be larger than the extraction
+	// size limit, for the headers of entries that are stored uncompressed
+	extractZipSlack = 64 << 20
+)
+
+var (
+	errExtractLimit   = errors.New("archive exceeds the extraction limits")
+	errInvalidArchive = errors.New("invalid archive")
+)
+
+// extractEntry is one entry of an extracted archive. Skipped tells why an
+// entry was not extracted.
+type extractEntry struct {
+	Path    string `json:"path"`
+	IsDir   bool   `json:"is_dir,omitempty"`
+	Size    int64  `json:"size"`
+	Skipped string `json:"skipped,omitempty"`
+}
+
+type extractReport struct {
+	Version    int            `json:"version"`
+	Title      string         `json:"-"`
+	ListingURL string         `json:"-"`
+	Path       string         `json:"path"`
+	Archives   []string       `json:"archives"`
+	Files      int            `json:"files"`
+	Size       int64          `json:"size"`
+	Entries    []extractEntry `json:"entries"`
+}
+
+// archiveFormat returns the archive format of a file name, or "" for files
+// that cannot be extracted.
+func archiveFormat(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return archiveZip
+	case strings.HasSuffix(name, ".tar"):
+		return archiveTar
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		return archiveTarGz
+	case strings.HasSuffix(name, ".tar.zst") || strings.HasSuffix(name, ".tzst"):
+		return archiveTarZst
+	}
+	return ""
+}
+
+// extractor writes the entries of archives below osPath and keeps count of
+// the entries and bytes against the limits of the route.
+type extractor struct {
+	f      *FileHandler
+	r      *http.Request
+	osPath string
+	report *extractReport
+	// entries counts every entry, also skipped ones
+	entries int
+}
+
+func (e *extractor) skip(name string, isDir bool, reason string) {
+	e.report.Entries = append(e.report.Entries, extractEntry{Path: name, IsDir: isDir, Skipped: reason})
+}
+
+// add extracts one archive entry. Entries with unsafe paths, links and
+// other special files are skipped and reported.
+func (e *extractor) add(name string, mode os.FileMode, modTime time.Time, body io.Reader) error {
+	e.entries++
+	if e.f.extractMaxFiles > 0 && e.entries > e.f.extractMaxFiles {
+		return fmt.Errorf("%w: more than %d entries", errExtractLimit, e.f.extractMaxFiles)
+	}
+	if mode.IsDir() && path.Clean(name) == "." {
+		return nil
+	}
+	rel, err := relPath(name)
+	if err != nil {
+		e.skip(name, mode.IsDir(), "unsafe path")
+		return nil
+	}
+	if !mode.IsDir() && !mode.IsRegular() {
+		e.skip(rel, false, "not a regular file")
+		return nil
+	}
+	if mode.IsDir() {
+		dir, err := e.f.uploadDir(e.r, e.osPath, rel)
+		if errors.Is(err, errInvalidPath) {
+			e.skip(rel, true, err.Error())
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !modTime.IsZero() {
+			_ = os.Chtimes(dir, modTime, modTime)
+		}
+		e.report.Entries = append(e.report.Entries, extractEntry{Path: rel, IsDir: true})
+		return nil
+	}
+
+	dir, err := e.f.uploadDir(e.r, e.osPath, path.Dir(rel))
+	if errors.Is(err, errInvalidPath) {
+		e.skip(rel, false, err.Error())
+		return nil
+	} else if err != nil {
+		return err
+	}
+	outPath := filepath.Join(dir, path.Base(rel))
+	if info, err := os.Lstat(outPath); err == nil && !info.Mode().IsRegular() {
+		e.skip(rel, false, "exists and is not a file")
+		return nil
+	}
+	if e.f.extractMaxSize > 0 {
+		body = io.LimitReader(body, e.f.extractMaxSize-e.report.Size+1)
+	}
+	body, charge, err := e.f.limitUpload(e.r, outPath, body)
+	if err != nil {
+		return err
+	}
+	defer e.f.releaseUpload(charge)
+	tmp, n, err := writeTemp(outPath, mode.Perm()|0600, body)
+	e.report.Size += n
+	if err == nil && e.f.extractMaxSize > 0 && e.report.Size > e.f.extractMaxSize {
+		os.Remove(tmp)
+		err = fmt.Errorf("%w: more than %d bytes", errExtractLimit, e.f.extractMaxSize)
+	}
+	if err != nil {
+		return err
+	}
+	if !modTime.IsZero() {
+		_ = os.Chtimes(tmp, modTime, modTime)
+	}
+	saved, err := e.f.place(tmp, outPath)
+	if errors.Is(err, errExists) {
+		os.Remove(tmp)
+		e.skip(rel, false, "exists")
+		return nil
+	} else if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	e.f.recordUpload(charge, saved, n)
+	if saved != outPath {
+		rel = path.Join(path.Dir(rel), filepath.Base(saved))
+	}
+	e.report.Files++
+	e.report.Entries = append(e.report.Entries, extractEntry{Path: rel, Size: n})
+	return nil
+}
+
+// extractTar extracts a tar stream.
+func (e *extractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidArchive, err)
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		mode := header.FileInfo().Mode()
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeDir {
+			// hard links and the like look regular but have no data
+			mode |= os.ModeIrregular
+		}
+		if err := e.add(header.Name, mode, header.ModTime, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// extractZip extracts a zip file. The sizes in the central directory are
+// checked before anything is written; the entries are still counted while
+// they are written, as the directory may lie.
+func (e *extractor) extractZip(file *os.File, size int64) error {
+	zr, err := zip.NewReader(file, size)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidArchive, err)
+	}
+	if e.f.extractMaxFiles > 0 && e.entries+len(zr.File) > e.f.extractMaxFiles {
+		return fmt.Errorf("%w: more than %d entries", errExtractLimit, e.f.extractMaxFiles)
+	}
+	var total uint64
+	for _, zf := range zr.File {
+		total += zf.UncompressedSize64
+	}
+	if e.f.extractMaxSize > 0 && total > uint64(e.f.extractMaxSize-e.report.Size) {
+		return fmt.Errorf("%w: more than %d bytes", errExtractLimit, e.f.extractMaxSize)
+	}
+	for _, zf := range zr.File {
+		rc, err := zf.Open()
+		if err != nil {
+			e.skip(zf.Name, false, err.Error())
+			continue
+		}
+		err = e.add(zf.Name, zf.Mode(), zf.Modified, rc)
+		rc.Close()
+		if errors.Is(err, zip.ErrChecksum) || errors.Is(err, zip.ErrFormat) || errors.Is(err, zip.ErrAlgorithm) {
+			return fmt.Errorf("%w: %v", errInvalidArchive, err)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractPart extracts one uploaded archive. Zip files are read from the
+// end, so they are written to the state directory first.
+func (e *extractor) extractPart(part io.Reader, format string) error {
+	switch format {
+	case archiveTar:
+		return e.extractTar(part)
+	case archiveTarGz:
+		gz, err := gzip.NewReader(part)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidArchive, err)
+		}
+		defer gz.Close()
+		return e.extractTar(gz)
+	case archiveTarZst:
+		zr, err := zstd.NewReader(part, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(extractMaxWindow))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		return e.extractTar(zr)
+	}
+
+	staging := filepath.Join(e.f.stateDir, extractStagingDir)
+	if err := os.MkdirAll(staging, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(staging, "upload-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	var limit int64 = -1
+	if e.f.extractMaxSize > 0 {
+		limit = e.f.extractMaxSize - e.report.Size + extractZipSlack
+		part = io.LimitReader(part, limit+1)
+	}
+	size, err := io.Copy(tmp, part)
+	if err != nil {
+		return err
+	}
+	if limit >= 0 && size > limit {
+		return fmt.Errorf("%w: more than %d bytes", errExtractLimit, e.f.extractMaxSize)
+	}
+	return e.extractZip(tmp, size)
+}
+
+// serveExtract answers POST ?extract with multipart archives (zip, tar,
+// tar.gz or tar.zst) by extracting them into the folder osPath, and reports
+// the extracted entries.
+func (f *FileHandler) serveExtract(w http.ResponseWriter, r *http.Request, osPath string) error {
+	if f.maxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, f.maxUploadSize)
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidArchive, err)
+	}
+	rel, _ := filepath.Rel(f.path, osPath)
+	report := extractReport{
+		Version:    listingSchemaVersion,
+		Title:      strings.Replace(path.Join(filepath.Base(f.path), rel), "\\", "/", -1),
+		ListingURL: (&url.URL{Path: r.URL.Path}).String(),
+		Path:       r.URL.Path,
+		Archives:   []string{},
+		Entries:    []extractEntry{},
+	}
+	e := extractor{f: f, r: r, osPath: osPath, report: &report}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+		format := archiveFormat(part.FileName())
+		if format == "" {
+			return fmt.Errorf("%w: %q is not a zip, tar, tar.gz or tar.zst file", errInvalidArchive, part.FileName())
+		}
+		report.Archives = append(report.Archives, part.FileName())
+		if err := e.extractPart(part, format); err != nil {
+			return err
+		}
+	}
+
+	if wantsJSON(r) {
+		return writeJSON(w, http.StatusOK, report)
+	}
+	tmpl := extractTemplate
+	if f.customTemplate != "" {
+		if custom, e := template.ParseFiles(f.customTemplate + osPathSeparator + "extract.html"); e == nil {
+			tmpl = custom
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return tmpl.Execute(w, report)
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// moveFile renames src to dst. When both are on different file systems
+// the data is copied to a temporary file next to dst first, so dst never
+// holds a partially written file.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GehirnInc/crypt"
+	_ "github.com/GehirnInc/crypt/apr1_crypt"
+	_ "github.com/GehirnInc/crypt/sha256_crypt"
+	_ "github.com/GehirnInc/crypt/sha512_crypt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd holds the users of an htpasswd file and their groups from an
+// optional htgroup file ("group: user1 user2"). Both files are reloaded
+// when they change on disk.
+type Htpasswd struct {
+	path      string
+	groupPath string
+
+	mu           sync.Mutex
+	users        map[string]string
+	groups       map[string][]string
+	modTime      time.Time
+	groupModTime time.Time
+	// verified caches successful checks, bcrypt is too slow to run on every request
+	verified map[[sha256.Size]byte]bool
+}
+
+func LoadHtpasswd(path, groupPath string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path, groupPath: groupPath}
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func modTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// readLines returns the "key:value" lines of a file, skipping blanks and comments.
+func readLines(path string, fn func(key, value string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return fmt.Errorf("%s:%d: expected \"name:value\"", path, n)
+		}
+		if err := fn(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// reload reads the files again if they were modified. Called with h.mu held
+// or before h is shared.
+func (h *Htpasswd) reload() error {
+	mt, err := modTime(h.path)
+	if err != nil {
+		return err
+	}
+	if !mt.Equal(h.modTime) {
+		users := make(map[string]string)
+		err = readLines(h.path, func(user, hash string) error {
+			if !isSupportedHash(hash) {
+				return fmt.Errorf("unsupported hash for user %q, use bcrypt, SHA-crypt, apr1 or {SHA}", user)
+			}
+			users[user] = hash
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		h.users, h.modTime = users, mt
+		h.verified = make(map[[sha256.Size]byte]bool)
+	}
+
+	if h.groupPath == "" {
+		return nil
+	}
+	mt, err = modTime(h.groupPath)
+	if err != nil {
+		return err
+	}
+	if !mt.Equal(h.groupModTime) {
+		groups := make(map[string][]string)
+		err = readLines(h.groupPath, func(group, members string) error {
+			for _, user := range strings.Fields(members) {
+				groups[user] = append(groups[user], group)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		h.groups, h.groupModTime = groups, mt
+	}
+	return nil
+}
+
+func isSupportedHash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return true
+	case strings.HasPrefix(hash, "{SHA}"):
+		return true
+	}
+	return crypt.IsHashSupported(hash)
+}
+
+func verifyHash(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	case crypt.IsHashSupported(hash):
+		return crypt.NewFromHash(hash).Verify(hash, []byte(password)) == nil
+	}
+	return false
+}
+
+// Authenticate reports whether user exists and password matches its hash.
+func (h *Htpasswd) Authenticate(user, password string) bool {
+	h.mu.Lock()
+	if err := h.reload(); err != nil {
+		log.Println("htpasswd:", err)
+	}
+	hash, ok := h.users[user]
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+	cached := h.verified[key]
+	h.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if cached {
+		return true
+	}
+	if !verifyHash(hash, password) {
+		return false
+	}
+	h.mu.Lock()
+	h.verified[key] = true
+	h.mu.Unlock()
+	return true
+}
+
+// Groups returns the groups user is a member of.
+func (h *Htpasswd) Groups(user string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.groups[user]
+}
+
+// Allowed reports whether user is listed in users or belongs to one of
+// groups. Empty lists allow every user of the file.
+func (h *Htpasswd) Allowed(user string, users, groups []string) bool {
+	if len(users) == 0 && len(groups) == 0 {
+		return true
+	}
+	for _, u := range users {
+		if u == user {
+			return true
+		}
+	}
+	for _, g := range h.Groups(user) {
+		for _, allowed := range groups {
+			if g == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// indexRebuildInterval is how often the index is rebuilt from scratch, to
+// pick up changes the watches miss (e.g. made by other NFS clients).
+const indexRebuildInterval = time.Hour
+
+// index keeps the entries of every folder of a route in memory and updates
+// them from file system events. Folders that could not be watched are not
+// in the index, and lookups for them fall back to the disk.
+type index struct {
+	root    string
+	watcher *fsnotify.Watcher
+
+	mu   sync.RWMutex
+	dirs map[string]map[string]os.FileInfo
+}
+
+func newIndex(root string) (*index, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	x := &index{root: root, watcher: watcher, dirs: make(map[string]map[string]os.FileInfo)}
+	start := time.Now()
+	x.addTree(root)
+	x.mu.RLock()
+	log.Printf("indexed %d folders of %q in %v", len(x.dirs), root, time.Since(start).Round(time.Millisecond))
+	x.mu.RUnlock()
+	go x.watch()
+	go x.rebuildLoop()
+	return x, nil
+}
+
+// scan reads dir from the disk and watches it. It returns the entries and
+// the sub folders, or nil if dir cannot be indexed.
+func (x *index) scan(dir string) (map[string]os.FileInfo, []string) {
+	if err := x.watcher.Add(dir); err != nil {
+		log.Printf("index: cannot watch %q: %v", dir, err)
+		return nil, nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		_ = x.watcher.Remove(dir)
+		return nil, nil
+	}
+	defer d.Close()
+	infos, err := d.Readdir(-1)
+	if err != nil {
+		_ = x.watcher.Remove(dir)
+		return nil, nil
+	}
+	entries := make(map[string]os.FileInfo, len(infos))
+	var subDirs []string
+	for _, info := range infos {
+		entries[info.Name()] = info
+		if info.IsDir() {
+			subDirs = append(subDirs, filepath.Join(dir, info.Name()))
+		}
+	}
+	return entries, subDirs
+}
+
+// addTree indexes dir and everything below it.
+func (x *index) addTree(dir string) {
+	pending := []string{dir}
+	for len(pending) > 0 {
+		dir := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		entries, subDirs := x.scan(dir)
+		if entries == nil {
+			continue
+		}
+		x.mu.Lock()
+		x.dirs[dir] = entries
+		x.mu.Unlock()
+		pending = append(pending, subDirs...)
+	}
+}
+
+// dropTree removes dir and everything below it from the index.
+func (x *index) dropTree(dir string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	prefix := dir + osPathSeparator
+	for p := range x.dirs {
+		if p == dir || strings.HasPrefix(p, prefix) {
+			delete(x.dirs, p)
+			_ = x.watcher.Remove(p)
+		}
+	}
+}
+
+// update brings the entry for p in line with the disk.
+func (x *index) update(p string) {
+	if !within(x.root, p) || p == x.root {
+		return
+	}
+	info, err := os.Lstat(p)
+	parent, name := filepath.Dir(p), filepath.Base(p)
+
+	x.mu.Lock()
+	old, known := x.dirs[parent][name]
+	if entries, ok := x.dirs[parent]; ok {
+		if err != nil {
+			delete(entries, name)
+		} else {
+			entries[name] = info
+		}
+	}
+	_, indexed := x.dirs[p]
+	x.mu.Unlock()
+
+	switch {
+	case err != nil && known && old.IsDir(), err == nil && !info.IsDir() && indexed:
+		x.dropTree(p)
+	case err == nil && info.IsDir() && !indexed:
+		x.addTree(p)
+	}
+}
+
+// refresh updates dir and its entries right away, so a listing requested
+// right after a change does not wait for the file system events.
+func (x *index) refresh(dir string) {
+	x.update(dir)
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		seen[name] = true
+		x.update(filepath.Join(dir, name))
+	}
+	x.mu.RLock()
+	var gone []string
+	for name := range x.dirs[dir] {
+		if !seen[name] {
+			gone = append(gone, filepath.Join(dir, name))
+		}
+	}
+	x.mu.RUnlock()
+	for _, p := range gone {
+		x.update(p)
+	}
+}
+
+func (x *index) watch() {
+	for {
+		select {
+		case event, ok := <-x.watcher.Events:
+			if !ok {
+				return
+			}
+			x.update(event.Name)
+		case err, ok := <-x.watcher.Errors:
+			if !ok {
+				return
+			}
+			// events were lost, start over
+			log.Printf("index %q: %v", x.root, err)
+			x.rebuild()
+		}
+	}
+}
+
+// rebuild indexes the whole route again and replaces the current index.
+func (x *index) rebuild() {
+	fresh := &index{root: x.root, watcher: x.watcher, dirs: make(map[string]map[string]os.FileInfo)}
+	fresh.addTree(x.root)
+	x.mu.Lock()
+	for p := range x.dirs {
+		if _, ok := fresh.dirs[p]; !ok {
+			_ = x.watcher.Remove(p)
+		}
+	}
+	x.dirs = fresh.dirs
+	x.mu.Unlock()
+}
+
+func (x *index) rebuildLoop() {
+	for {
+		time.Sleep(indexRebuildInterval)
+		x.rebuild()
+	}
+}
+
+// readDir returns the entries of dir, or false if dir is not indexed.
+func (x *index) readDir(dir string) ([]os.FileInfo, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	entries, ok := x.dirs[dir]
+	if !ok {
+		return nil, false
+	}
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, info := range entries {
+		files = append(files, info)
+	}
+	return files, true
+}
+
+// count returns the number of entries of dir, or false if dir is not indexed.
+func (x *index) count(dir string) (int, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	entries, ok := x.dirs[dir]
+	return len(entries), ok
+}
+
+// treeSize returns the size and number of regular files below dir, or
+// false if a folder below dir is not indexed.
+func (x *index) treeSize(dir string) (size, files int64, ok bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	pending := []string{dir}
+	for len(pending) > 0 {
+		dir := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		entries, ok := x.dirs[dir]
+		if !ok {
+			return 0, 0, false
+		}
+		for name, info := range entries {
+			switch {
+			case info.IsDir():
+				pending = append(pending, filepath.Join(dir, name))
+			case info.Mode().IsRegular():
+				size += info.Size()
+				files++
+			}
+		}
+	}
+	return size, files, true
+}
+
+// walk is filepath.Walk served from the index. Folders that are not
+// indexed are walked on the disk.
+func (x *index) walk(root string, fn filepath.WalkFunc) error {
+	x.mu.RLock()
+	parent, hasParent := x.dirs[filepath.Dir(root)]
+	info, ok := parent[filepath.Base(root)]
+	x.mu.RUnlock()
+	if root == x.root || !hasParent || !ok {
+		var err error
+		if info, err = os.Lstat(root); err != nil {
+			return fn(root, nil, err)
+		}
+	}
+	err := x.walkDir(root, info, fn)
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func (x *index) walkDir(p string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(p, info, nil)
+	}
+	files, ok := x.readDir(p)
+	if !ok {
+		return filepath.Walk(p, fn)
+	}
+	if err := fn(p, info, nil); err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	for _, file := range files {
+		err := x.walkDir(filepath.Join(p, file.Name()), file, fn)
+		if err == filepath.SkipDir {
+			if file.IsDir() {
+				continue
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	formatKey       = "format"
+	formatJSON      = "json"
+	jsonContentType = "application/json"
+	pageKey         = "page"
+	limitKey        = "limit"
+
+	// listingSchemaVersion is bumped on every incompatible change of jsonListing.
+	listingSchemaVersion = 1
+	defaultListingLimit  = 1000
+	maxListingLimit      = 10000
+)
+
+// jsonListing is the machine-readable form of directoryListingData.
+type jsonListing struct {
+	Version int        `json:"version"`
+	Path    string     `json:"path"`
+	Page    int        `json:"page"`
+	Limit   int        `json:"limit"`
+	Total   int        `json:"total"`
+	Pages   int        `json:"pages"`
+	Next    string     `json:"next,omitempty"`
+	Prev    string     `json:"prev,omitempty"`
+	Files   []jsonFile `json:"files"`
+	// Quota is left out where there is no quota or no upload permission.
+	Quota *quotaStatus `json:"quota,omitempty"`
+	// Checksums is the URL of the SHA256SUMS of the folder, if it is served.
+	Checksums string `json:"checksums,omitempty"`
+}
+
+// jsonFile is the machine-readable form of directoryListingFileData.
+type jsonFile struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	IsDir    bool   `json:"is_dir"`
+	Type     string `json:"type"`
+	Size     int64  `json:"size"`
+	Children *int   `json:"children,omitempty"`
+	// TreeSize and TreeFiles are left out while a folder is measured.
+	TreeSize  *int64 `json:"tree_size,omitempty"`
+	TreeFiles *int64 `json:"tree_files,omitempty"`
+	Modified  string `json:"modified"`
+	Hidden    bool   `json:"hidden"`
+	Thumb     string `json:"thumb,omitempty"`
+}
+
+// wantsJSON reports whether the client asked for a JSON response
+// either with ?format=json or with an Accept header.
+func wantsJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get(formatKey); format != "" {
+		return format == formatJSON
+	}
+	return strings.Contains(r.Header.Get("Accept"), jsonContentType)
+}
+
+// queryInt returns a positive integer query parameter or def.
+func queryInt(r *http.Request, key string, def int) int {
+	v, err := strconv.Atoi(r.URL.Query().Get(key))
+	if err != nil || v < 1 {
+		return def
+	}
+	return v
+}
+
+func pageURL(r *http.Request, page int) string {
+	u := *r.URL
+	q := u.Query()
+	q.Set(pageKey, strconv.Itoa(page))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", jsonContentType+"; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// pagination is one page of a listing of total entries.
+type pagination struct {
+	Page  int
+	Pages int
+	Limit int
+	Total int
+	start int
+	end   int
+}
+
+// paginate returns the page of total entries asked for with ?page and ?limit.
+func paginate(r *http.Request, total int) pagination {
+	p := pagination{Limit: queryInt(r, limitKey, defaultListingLimit), Page: queryInt(r, pageKey, 1), Total: total}
+	if p.Limit > maxListingLimit {
+		p.Limit = maxListingLimit
+	}
+	p.Pages = (total + p.Limit - 1) / p.Limit
+	if p.Pages == 0 {
+		p.Pages = 1
+	}
+	// pages past the last show the last one, which also keeps huge page
+	// numbers from overflowing the offset
+	if p.Page > p.Pages {
+		p.Page = p.Pages
+	}
+	p.start = (p.Page - 1) * p.Limit
+	if p.start < 0 {
+		p.start = 0
+	} else if p.start > total {
+		p.start = total
+	}
+	p.end = p.start + p.Limit
+	if p.end > total || p.end < p.start {
+		p.end = total
+	}
+	return p
+}
+
+func (f *FileHandler) serveDirJSON(w http.ResponseWriter, r *http.Request, osPath string, files []os.FileInfo, perms permissions) error {
+	p := paginate(r, len(files))
+	data := f.directoryListing(r, osPath, files[p.start:p.end], perms)
+	out := jsonListing{
+		Version: listingSchemaVersion,
+		Path:    data.Title,
+		Page:    p.Page,
+		Limit:   p.Limit,
+		Total:   p.Total,
+		Pages:   p.Pages,
+		Files:   make([]jsonFile, 0, len(data.Files)),
+		Quota:   data.Quota,
+	}
+	if data.ChecksumsURL != nil {
+		out.Checksums = data.ChecksumsURL.String()
+	}
+	if p.Page < p.Pages {
+		out.Next = pageURL(r, p.Page+1)
+	}
+	if p.Page > 1 {
+		out.Prev = pageURL(r, p.Page-1)
+	}
+	for _, file := range data.Files {
+		out.Files = append(out.Files, newJSONFile(file))
+	}
+	return writeJSON(w, http.StatusOK, out)
+}
+
+func newJSONFile(file directoryListingFileData) jsonFile {
+	out := jsonFile{
+		Name:     file.Name,
+		URL:      (&url.URL{Path: file.URL.Path}).String(),
+		IsDir:    file.IsDir,
+		Type:     file.Type,
+		Size:     int64(file.Size),
+		Modified: file.ModTime.UTC().Format(time.RFC3339),
+		Hidden:   file.IsHidden,
+		Thumb:    file.ThumbURL,
+	}
+	if file.IsDir {
+		count := file.FCount
+		out.Children = &count
+	}
+	if file.HasTreeSize {
+		size, files := int64(file.TreeSize), file.TreeFiles
+		out.TreeSize, out.TreeFiles = &size, &files
+	}
+	return out
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"github.com/dastoori/higgs"
 	"github.com/muller2002/http-file-server/utils"
+	"golang.org/x/net/webdav"
 	"io"
 	"path/filepath"
 )
@@ -16,19 +17,19 @@ import (
 	"net/url"
 	"os"
 	"path"
-	"sort"
 	"strings"
+	"time"
 )
 
 const (
-	newFolderKey     = "new"
-	tarGzKey         = "tar.gz"
-	tarGzValue       = "true"
-	tarGzContentType = "application/x-tar+gzip"
-	zipKey           = "zip"
-	zipValue         = "true"
-	zipContentType   = "application/zip"
-	osPathSeparator  = string(filepath.Separator)
+	newFolderKey    = "new"
+	tarGzKey        = "tar.gz"
+	tarGzValue      = "true"
+	zipKey          = "zip"
+	zipValue        = "true"
+	archiveKey      = "archive"
+	levelKey        = "level"
+	osPathSeparator = string(filepath.Separator)
 )
 
 func isHidden(p string) bool {
@@ -51,6 +52,50 @@ func getItems(r *http.Request) []string {
 	return items
 }
 
+// archiveItems returns the entries of osPath to put in an archive: the
+// selected items, or the entries matching ?filter of the listing. Items
+// that are not below osPath are refused.
+func (f *FileHandler) archiveItems(r *http.Request, osPath string) ([]string, error) {
+	items := getItems(r)
+	if len(items) > 0 {
+		clean := make([]string, 0, len(items))
+		for _, item := range items {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			rel, err := relPath(item)
+			if err != nil {
+				return nil, err
+			}
+			if !withinNoLinks(osPath, filepath.Join(osPath, filepath.FromSlash(rel))) {
+				return nil, fmt.Errorf("%w: %q", errInvalidPath, item)
+			}
+			clean = append(clean, rel)
+		}
+		if len(clean) == 0 {
+			// an empty name keeps the archive empty
+			clean = append(clean, "")
+		}
+		return clean, nil
+	}
+	if r.URL.Query().Get(filterKey) == "" {
+		return nil, nil
+	}
+	files, err := f.readDir(osPath)
+	if err == nil {
+		files, err = filterFiles(r, files)
+	}
+	if err != nil {
+		log.Println("archive filter:", err)
+	}
+	// an empty name keeps the archive empty when nothing matches
+	items = []string{""}
+	for _, info := range files {
+		items = append(items, info.Name())
+	}
+	return items, nil
+}
+
 type fileSizeBytes int64
 
 func (f fileSizeBytes) String() string {
@@ -77,25 +122,74 @@ func (f fileSizeBytes) String() string {
 }
 
 type directoryListingFileData struct {
-	Name     string
-	Size     fileSizeBytes
-	IsDir    bool
-	Type     string
-	FCount   int
-	Modified string
-	URL      *url.URL
-	IsHidden bool
+	Name   string
+	Size   fileSizeBytes
+	IsDir  bool
+	Type   string
+	FCount int
+	// TreeSize and TreeFiles are the recursive size and number of files
+	// of a folder, if HasTreeSize is set.
+	HasTreeSize bool
+	// ThumbURL is set for images and points to their thumbnail.
+	ThumbURL string
+	// PreviewURL is set for files and shows them in the browser.
+	PreviewURL string
+	TreeSize   fileSizeBytes
+	TreeFiles  int64
+	Modified   string
+	ModTime    time.Time
+	URL        *url.URL
+	IsHidden   bool
+}
+
+type archiveLink struct {
+	Format string
+	URL    *url.URL
 }
 
 type directoryListingData struct {
-	Title         string
-	ZipURL        *url.URL
-	TarGzURL      *url.URL
-	Files         []directoryListingFileData
-	AllowUpload   bool
-	AllowDelete   bool
-	AllowCreate   bool
+	Title    string
+	ZipURL   *url.URL
+	TarGzURL *url.URL
+	// Archives are the download links of the folder in every archive
+	// format.
+	Archives    []archiveLink
+	Files       []directoryListingFileData
+	AllowUpload bool
+	AllowDelete bool
+	AllowCreate bool
+	AllowRename bool
+	TrashURL    *url.URL
+	// ChecksumsURL points to the SHA256SUMS of the folder, if the route
+	// serves them.
+	ChecksumsURL  *url.URL
 	NoAllowHidden bool
+	// Header and Footer are the rendered header and footer files of the
+	// folder, e.g. its README.md.
+	Header template.HTML
+	Footer template.HTML
+	// Gallery is set for ?view=gallery, ViewURL switches the view.
+	Gallery bool
+	ViewURL *url.URL
+	// Sort, Order and Filter are the ?sort, ?order and ?filter of the
+	// listing, SortURLs the links that sort by each column.
+	Sort     string
+	Order    string
+	Filter   string
+	SortURLs map[string]*url.URL
+	// Page and Pages number the pages of a listing with more than Limit
+	// entries, the URLs are empty where there is no such page.
+	Page     int
+	Pages    int
+	Limit    int
+	Total    int
+	FirstURL string
+	PrevURL  string
+	NextURL  string
+	LastURL  string
+	// Quota is the usage of the route or the user, for those who may
+	// upload to a route with quotas.
+	Quota *quotaStatus
 }
 
 type FileHandler struct {
@@ -104,54 +198,209 @@ type FileHandler struct {
 	allowUpload    bool
 	allowDelete    bool
 	allowCreate    bool
+	allowRename    bool
 	customTemplate string
 	noAllowHidden  bool
+	webdav         *webdav.Handler
+	stateDir       string
+	maxUploadSize  int64
+	// extractMaxSize and extractMaxFiles limit what one ?extract upload may
+	// unpack, 0 for no limit
+	extractMaxSize  int64
+	extractMaxFiles int
+	conflict        string
+	// maxFileSize limits single files, quotas the space of the route and
+	// its users; both are enforced while uploads stream in
+	maxFileSize    int64
+	quotas         *quotas
+	headers        map[string]string
+	htpasswd       *Htpasswd
+	rules          []RoleRule
+	defaultRole    role
+	trashDir       string
+	trashRetention time.Duration
+	index          *index
+	dirSizes       *dirSizeCache
+	// checksumFiles serves SHA256SUMS and the like in every folder
+	checksumFiles bool
+	header        []string
+	footer        []string
 }
 
-func (f *FileHandler) serveTarGz(w http.ResponseWriter, r *http.Request, path string) error {
-	w.Header().Set("Content-Type", tarGzContentType)
-	name := filepath.Base(path) + ".tar.gz"
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, name))
-	items := getItems(r)
-	return utils.TarGz(w, path, items)
-}
-
-func (f *FileHandler) serveZip(w http.ResponseWriter, r *http.Request, osPath string) error {
-	w.Header().Set("Content-Type", zipContentType)
-	name := filepath.Base(osPath) + ".zip"
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, name))
-	items := getItems(r)
-	return utils.Zip(w, osPath, items)
+// requestedArchive returns the archive format asked for with ?archive=,
+// ?zip or ?tar.gz, and whether one was asked for.
+func requestedArchive(r *http.Request) (string, bool) {
+	q := r.URL.Query()
+	switch {
+	case q.Has(archiveKey):
+		return q.Get(archiveKey), true
+	case q.Has(zipKey):
+		return zipKey, true
+	case q.Has(tarGzKey):
+		return tarGzKey, true
+	}
+	return "", false
 }
 
-func (f *FileHandler) serveDir(w http.ResponseWriter, r *http.Request, osPath string) error {
-	d, err := os.Open(osPath)
+// serveArchive answers ?archive=<format> with an archive of the folder
+// osPath, compressed with ?level=0-9 where the format has levels.
+func (f *FileHandler) serveArchive(w http.ResponseWriter, r *http.Request, osPath string) error {
+	name, _ := requestedArchive(r)
+	format, ok := utils.LookupArchiveFormat(name)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintf(w, "unknown archive format %q, want %s", name, strings.Join(utils.ArchiveFormats(), ", "))
+		return nil
+	}
+	level, err := utils.ParseLevel(r.FormValue(levelKey))
 	if err != nil {
-		return err
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return nil
 	}
-	files, err := d.Readdir(-1)
+	items, err := f.archiveItems(r, osPath)
 	if err != nil {
-		return err
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return nil
 	}
-	sort.Slice(files, func(i, j int) bool { return strings.ToLower(files[i].Name()) < strings.ToLower(files[j].Name()) })
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, filepath.Base(osPath)+"."+format.Name))
+	return utils.WriteArchive(w, format, osPath, items, level, f.hiddenEntry)
+}
 
-	if f.customTemplate != "" {
-		var e error
-		directoryListingTemplate, e = template.ParseFiles(f.customTemplate + osPathSeparator + "base.html")
-		if e != nil {
-			fmt.Println("can`t load custom template", e)
+// hiddenEntry reports whether the file or folder at absPath is left out of
+// listings, search results and archives: hidden files when the route does
+// not allow them, the trash and state folders and the working files of
+// uploads, copies and kept versions.
+func (f *FileHandler) hiddenEntry(absPath string) bool {
+	return f.noAllowHidden && isHidden(absPath) ||
+		isWorkingFile(filepath.Base(absPath)) ||
+		f.trashDir != "" && absPath == f.trashDir ||
+		f.stateDir != "" && absPath == f.stateDir
+}
+
+// readDir returns the entries of osPath the route is allowed to show,
+// directories first, each group sorted case-insensitively by name.
+func (f *FileHandler) readDir(osPath string) ([]os.FileInfo, error) {
+	files, ok := []os.FileInfo(nil), false
+	if f.index != nil {
+		files, ok = f.index.readDir(osPath)
+	}
+	if !ok {
+		d, err := os.Open(osPath)
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		files, err = d.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	visible := files[:0]
+	for _, info := range files {
+		if f.hiddenEntry(osPath + osPathSeparator + info.Name()) {
+			continue
+		}
+		visible = append(visible, info)
+	}
+	files = visible
+	sortFiles(files, sortName, orderAsc)
+	return files, nil
+}
+
+// childCount returns the number of entries of the folder absPath.
+func (f *FileHandler) childCount(absPath string) int {
+	if f.index != nil {
+		if n, ok := f.index.count(absPath); ok {
+			return n
+		}
+	}
+	subD, e := os.ReadDir(absPath + osPathSeparator)
+	if e != nil {
+		fmt.Println(e)
+		fmt.Println(absPath)
+	}
+	return len(subD)
+}
+
+func (f *FileHandler) fileData(r *http.Request, osPath string, d os.FileInfo) directoryListingFileData {
+	name := d.Name()
+	absPath := osPath + osPathSeparator + name
+	fType := "DIR"
+	fCount := 0
+	var size dirSize
+	hasSize := false
+	if d.IsDir() {
+		fCount = f.childCount(absPath)
+		if f.dirSizes != nil {
+			size, hasSize = f.dirSize(absPath)
+		}
+	} else {
+		fType = strings.Replace(filepath.Ext(name), ".", "", 1)
+		if fType == "" {
+			fType = "File"
 		}
 	}
+	thumbURL, previewURL := "", ""
+	if !d.IsDir() {
+		previewURL = (&url.URL{Path: path.Join(r.URL.Path, name), RawQuery: previewKey}).String()
+	}
+	if !d.IsDir() && isImage(name) {
+		thumbURL = (&url.URL{Path: path.Join(r.URL.Path, name), RawQuery: thumbKey}).String()
+	}
+	return directoryListingFileData{
+		ThumbURL:    thumbURL,
+		PreviewURL:  previewURL,
+		Name:        name,
+		IsDir:       d.IsDir(),
+		Size:        fileSizeBytes(d.Size()),
+		Type:        fType,
+		FCount:      fCount,
+		HasTreeSize: hasSize,
+		TreeSize:    fileSizeBytes(size.Size),
+		TreeFiles:   size.Files,
+		IsHidden:    isHidden(absPath),
+		Modified:    d.ModTime().Format("2006-01-02 15:04:05"),
+		ModTime:     d.ModTime(),
+		URL: func() *url.URL {
+			u := *r.URL
+			u.RawQuery = ""
+			u.Path = path.Join(u.Path, name)
+			if d.IsDir() {
+				u.Path += "/"
+			}
+			return &u
+		}(),
+	}
+}
 
-	return directoryListingTemplate.Execute(w, directoryListingData{
-		AllowUpload:   f.allowUpload,
-		AllowDelete:   f.allowDelete,
-		AllowCreate:   f.allowCreate,
+func (f *FileHandler) directoryListing(r *http.Request, osPath string, files []os.FileInfo, perms permissions) directoryListingData {
+	data := directoryListingData{
+		AllowUpload: perms.upload,
+		AllowDelete: perms.delete,
+		AllowCreate: perms.create,
+		AllowRename: perms.rename,
+		TrashURL: func() *url.URL {
+			if f.trashDir == "" || !perms.delete {
+				return nil
+			}
+			return &url.URL{Path: f.route, RawQuery: trashKey}
+		}(),
+		ChecksumsURL: func() *url.URL {
+			if !f.checksumFiles {
+				return nil
+			}
+			return &url.URL{Path: path.Join(r.URL.Path, "SHA256SUMS")}
+		}(),
 		NoAllowHidden: f.noAllowHidden,
+		Filter:        r.URL.Query().Get(filterKey),
+		Gallery:       r.URL.Query().Get(viewKey) == viewGallery,
+		ViewURL:       viewURL(r, r.URL.Query().Get(viewKey) == viewGallery),
+		SortURLs:      sortURLs(r),
 		Title: func() string {
 			relPath, _ := filepath.Rel(f.path, osPath)
-			//return filepath.Join(filepath.Base(f.path), relPath)
 			tPath := path.Join(filepath.Base(f.path), relPath)
 			return strings.Replace(tPath, "\\", "/", -1)
 		}(),
@@ -169,85 +418,102 @@ func (f *FileHandler) serveDir(w http.ResponseWriter, r *http.Request, osPath st
 			u.RawQuery = q.Encode()
 			return &u
 		}(),
-		Files: func() (out []directoryListingFileData) {
-			// first directories then files (sorted)
-			var filesList []directoryListingFileData
-			for _, d := range files {
-				name := d.Name()
-				absPath := osPath + osPathSeparator + name
-				hidden := isHidden(absPath)
-				if f.noAllowHidden && hidden {
-					continue
-				}
+	}
+	for _, format := range utils.ArchiveFormats() {
+		u := *r.URL
+		q := u.Query()
+		q.Set(archiveKey, format)
+		u.RawQuery = q.Encode()
+		data.Archives = append(data.Archives, archiveLink{Format: format, URL: &u})
+	}
+	data.Sort, data.Order = listingOrder(r)
+	if f.quotas != nil && perms.upload {
+		data.Quota = f.quotas.status(requestUser(r))
+	}
+	for _, d := range files {
+		data.Files = append(data.Files, f.fileData(r, osPath, d))
+	}
+	return data
+}
 
-				fType := "DIR"
-				fCount := 0
-				if d.IsDir() {
-					subD, e := os.ReadDir(absPath + osPathSeparator)
-					if e == nil {
-						fCount = len(subD)
-					} else {
-						fmt.Println(e)
-						fmt.Println(absPath)
-					}
-				} else {
-					fType = strings.Replace(filepath.Ext(name), ".", "", 1)
-					if fType == "" {
-						fType = "File"
-					}
-				}
-				fileData := directoryListingFileData{
-					Name:     name,
-					IsDir:    d.IsDir(),
-					Size:     fileSizeBytes(d.Size()),
-					Type:     fType,
-					FCount:   fCount,
-					IsHidden: hidden,
-					Modified: d.ModTime().Format("2006-01-02 15:04:05"),
-					URL: func() *url.URL {
-						u := *r.URL
-						u.Path = path.Join(u.Path, name)
-						if d.IsDir() {
-							u.Path += "/"
-						}
-						return &u
-					}(),
-				}
-				if d.IsDir() {
-					out = append(out, fileData)
-				} else {
-					filesList = append(filesList, fileData)
-				}
-			}
-			out = append(out, filesList...)
-			return out
-		}(),
-	})
+func (f *FileHandler) serveDir(w http.ResponseWriter, r *http.Request, osPath string, perms permissions) error {
+	files, err := f.readDir(osPath)
+	if err != nil {
+		return err
+	}
+	files, err = filterFiles(r, files)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return nil
+	}
+	by, order := listingOrder(r)
+	sortFiles(files, by, order)
+	if wantsJSON(r) {
+		return f.serveDirJSON(w, r, osPath, files, perms)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	tmpl := directoryListingTemplate
+	if f.customTemplate != "" {
+		custom, e := template.ParseFiles(f.customTemplate + osPathSeparator + "base.html")
+		if e != nil {
+			fmt.Println("can`t load custom template", e)
+		} else {
+			tmpl = custom
+		}
+	}
+
+	p := paginate(r, len(files))
+	data := f.directoryListing(r, osPath, files[p.start:p.end], perms)
+	data.Page, data.Pages, data.Limit, data.Total = p.Page, p.Pages, p.Limit, p.Total
+	data.Header, data.Footer = f.renderReadme(osPath, f.header), f.renderReadme(osPath, f.footer)
+	if p.Page > 1 {
+		data.FirstURL, data.PrevURL = pageURL(r, 1), pageURL(r, p.Page-1)
+	}
+	if p.Page < p.Pages {
+		data.NextURL, data.LastURL = pageURL(r, p.Page+1), pageURL(r, p.Pages)
+	}
+	return tmpl.Execute(w, data)
 }
 
 func (f *FileHandler) serveUploadTo(w http.ResponseWriter, r *http.Request, osPath string) error {
+	if f.maxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, f.maxUploadSize)
+	}
 	mr, err := r.MultipartReader()
 	if err != nil {
 		return err
 	}
+	// the md5 and sha256 form fields apply to the file that follows them;
+	// digest headers of the request describe the whole multipart body and
+	// are left alone, those of a part apply to it
+	fieldDigests := digests{}
+	report := uploadReport{Version: listingSchemaVersion, Files: []uploadedFile{}}
 	for {
 		part, err := mr.NextPart()
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return err
-		} else if part.FormName() == "file" {
-			outPath := filepath.Join(osPath, filepath.Base(part.FileName()))
-			out, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY, 0600)
-			if err != nil {
+		}
+		switch part.FormName() {
+		case md5Field, sha256Field:
+			if err := readDigestField(fieldDigests, part.FormName(), part); err != nil {
 				return err
 			}
-			defer out.Close()
-			if _, err := io.Copy(out, part); err != nil {
+		case "file":
+			saved, err := f.saveUpload(r, osPath, part, fieldDigests)
+			if err != nil {
 				return err
 			}
+			report.Files = append(report.Files, saved)
+			fieldDigests = digests{}
 		}
 	}
+	if wantsJSON(r) {
+		return writeJSON(w, http.StatusOK, report)
+	}
 	w.Header().Set("Location", r.URL.String())
 	w.WriteHeader(303)
 	return nil
@@ -262,8 +528,22 @@ func (f *FileHandler) createNewFolder(w http.ResponseWriter, r *http.Request, os
 		w.WriteHeader(400)
 		return fmt.Errorf("name must not be empty")
 	}
-	log.Println("try create folder:", osPath+osPathSeparator+name)
-	err := os.Mkdir(osPath+osPathSeparator+name, 0665)
+	rel, err := relPath(name)
+	if err != nil {
+		w.WriteHeader(400)
+		return err
+	}
+	target := filepath.Join(osPath, filepath.FromSlash(rel))
+	if !withinNoLinks(f.path, target) {
+		w.WriteHeader(400)
+		return fmt.Errorf("%w: %q", errInvalidPath, name)
+	}
+	if !f.permissions(r, target).create {
+		w.WriteHeader(403)
+		return errForbidden
+	}
+	log.Println("try create folder:", target)
+	err = os.Mkdir(target, 0665)
 	if err != nil && !os.IsExist(err) {
 		w.WriteHeader(400)
 		log.Println("create folder", err)
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"os"
@@ -23,10 +24,12 @@ func (f *FileHandler) serveStatus(w http.ResponseWriter, r *http.Request, status
 	return nil
 }
 
-// ServeHTTP is http.Handler.ServeHTTP
-func (f *FileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[%s] %s %s %s", f.path, r.RemoteAddr, r.Method, r.URL.String())
-	urlPath := r.URL.Path
+func isMultipart(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+}
+
+// osPath maps the URL path of a request to a path below the route path.
+func (f *FileHandler) osPath(urlPath string) string {
 	if !strings.HasPrefix(urlPath, "/") {
 		urlPath = "/" + urlPath
 	}
@@ -34,10 +37,53 @@ func (f *FileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	urlPath = strings.TrimPrefix(urlPath, "/"+f.route)
 
 	osPath := strings.ReplaceAll(urlPath, "/", osPathSeparator)
-	osPath = filepath.Clean(osPath)
-	osPath = filepath.Join(f.path, osPath)
+	osPath = filepath.Clean(osPathSeparator + osPath)
+	return filepath.Join(f.path, osPath)
+}
+
+// isWriteMethod reports whether requests with method may change files.
+func isWriteMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return false
+	}
+	return true
+}
+
+// ServeHTTP is http.Handler.ServeHTTP
+func (f *FileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] %s %s %s", f.path, r.RemoteAddr, r.Method, r.URL.String())
+	for k, v := range f.headers {
+		w.Header().Set(k, v)
+	}
+	osPath := f.osPath(r.URL.Path)
+	perms := f.permissions(r, osPath)
+	if f.index != nil && isWriteMethod(r.Method) {
+		defer func() {
+			f.index.refresh(filepath.Dir(osPath))
+			f.index.refresh(osPath)
+		}()
+	}
+	if f.dirSizes != nil && isWriteMethod(r.Method) {
+		defer f.dirSizes.invalidate(f.path, osPath)
+	}
+
+	if isTusRequest(r) {
+		f.serveTus(w, r, osPath, perms)
+		return
+	}
+	if f.webdav != nil && isWebDAVMethod(r.Method) {
+		f.serveWebDAV(w, r, perms)
+		return
+	}
 	info, err := os.Stat(osPath)
+	_, hasArchive := requestedArchive(r)
 	switch {
+	case os.IsNotExist(err) && (r.Method == http.MethodGet || r.Method == http.MethodHead) && f.isChecksumFile(osPath):
+		err := f.serveChecksumFile(w, r, filepath.Dir(osPath), checksumFiles[filepath.Base(osPath)])
+		if err != nil {
+			log.Println("checksum:", err)
+		}
 	case os.IsNotExist(err):
 		_ = f.serveStatus(w, r, http.StatusNotFound)
 	case os.IsPermission(err):
@@ -45,50 +91,112 @@ func (f *FileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case err != nil:
 		log.Println(err)
 		_ = f.serveStatus(w, r, http.StatusInternalServerError)
-	case !f.allowDelete && r.Method == http.MethodDelete:
+	case !perms.delete && r.Method == http.MethodDelete:
 		_ = f.serveStatus(w, r, http.StatusForbidden)
-	case !f.allowUpload && r.Method == http.MethodPost && len(r.URL.Query().Get("")) != 0:
+	case !perms.upload && r.Method == http.MethodPost && isMultipart(r):
 		_ = f.serveStatus(w, r, http.StatusForbidden)
-	case !f.allowCreate && r.Method == http.MethodPost && r.URL.Query().Has(newFolderKey):
+	case !perms.create && r.Method == http.MethodPost && r.URL.Query().Has(newFolderKey):
 		_ = f.serveStatus(w, r, http.StatusForbidden)
-	case r.URL.Query().Has(zipKey) && r.Method == http.MethodGet:
-		err := f.serveZip(w, r, osPath)
+	case !perms.rename && (r.Method == "MOVE" || r.Method == http.MethodPost && r.URL.Query().Has(renameKey)):
+		_ = f.serveStatus(w, r, http.StatusForbidden)
+	case r.Method == "MOVE" || r.Method == http.MethodPost && r.URL.Query().Has(renameKey):
+		err := f.serveRename(w, r, osPath)
 		if err != nil {
-			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+			log.Println("rename:", err)
 		}
-	case r.URL.Query().Has(tarGzKey) && r.Method == http.MethodGet:
-		err := f.serveTarGz(w, r, osPath)
+	case r.Method == "COPY" || r.Method == http.MethodPost && r.URL.Query().Has(copyKey):
+		err := f.serveCopy(w, r, osPath, info)
 		if err != nil {
-			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+			log.Println("copy:", err)
 		}
-	case r.URL.Query().Has(zipKey) && r.Method == http.MethodPost:
-		err := f.serveZip(w, r, osPath)
+	case r.Method == http.MethodGet && r.URL.Query().Has(jobKey):
+		_ = f.serveJob(w, r)
+	case !info.IsDir() && r.Method == http.MethodGet && r.URL.Query().Has(previewKey):
+		err := f.servePreview(w, r, osPath, info)
 		if err != nil {
-			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+			log.Println("preview:", err)
+		}
+	case r.Method == http.MethodGet && r.URL.Query().Has(checksumKey):
+		err := f.serveChecksum(w, r, osPath, info)
+		if err != nil {
+			log.Println("checksum:", err)
+		}
+	case r.Method == http.MethodGet && r.URL.Query().Has(thumbKey):
+		err := f.serveThumb(w, r, osPath, info)
+		if err != nil {
+			log.Println("thumb:", err)
+		}
+	case info.IsDir() && r.Method == http.MethodGet && r.URL.Query().Has(searchKey):
+		err := f.serveSearch(w, r, osPath)
+		if err != nil {
+			log.Println("search:", err)
 		}
-	case r.URL.Query().Has(tarGzKey) && r.Method == http.MethodPost:
-		err := f.serveTarGz(w, r, osPath)
+	case r.URL.Query().Has(trashKey):
+		err := f.serveTrash(w, r)
 		if err != nil {
+			log.Println("trash:", err)
+		}
+	case hasArchive && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		err := f.serveArchive(w, r, osPath)
+		if err != nil {
+			log.Println("archive:", err)
+			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+		}
+	case perms.upload && info.IsDir() && r.Method == http.MethodPost && r.URL.Query().Has(extractKey):
+		err := f.serveExtract(w, r, osPath)
+		switch {
+		case isTooLarge(err):
+			f.serveTooLarge(w, r, err)
+		case errors.Is(err, errForbidden):
+			_ = f.serveStatus(w, r, http.StatusForbidden)
+		case errors.Is(err, errInvalidArchive):
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+		case err != nil:
 			_ = f.serveStatus(w, r, http.StatusInternalServerError)
 		}
-	case f.allowUpload && info.IsDir() && r.Method == http.MethodPost && r.URL.Query().Has(newFolderKey) == false:
-		err := f.serveUploadTo(w, r, osPath)
 		if err != nil {
+			log.Println("extract:", err)
+		}
+	case perms.upload && info.IsDir() && r.Method == http.MethodPost && r.URL.Query().Has(newFolderKey) == false:
+		err := f.serveUploadTo(w, r, osPath)
+		switch {
+		case isTooLarge(err):
+			f.serveTooLarge(w, r, err)
+		case errors.Is(err, errForbidden):
+			_ = f.serveStatus(w, r, http.StatusForbidden)
+		case errors.Is(err, errInvalidPath):
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+		case errors.Is(err, errExists):
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(err.Error()))
+		case isDigestError(err):
+			serveDigestError(w, err)
+		case err != nil:
 			_ = f.serveStatus(w, r, http.StatusInternalServerError)
 		}
-	case f.allowCreate && info.IsDir() && r.Method == http.MethodPost && r.URL.Query().Has(newFolderKey):
+		if err != nil {
+			log.Println("upload:", err)
+		}
+	case perms.create && info.IsDir() && r.Method == http.MethodPost && r.URL.Query().Has(newFolderKey):
 		err := f.createNewFolder(w, r, osPath)
 		if err != nil {
 			log.Println("error create folder:", err)
 			w.Write([]byte(err.Error() + ".  "))
 		}
-	case f.allowDelete && !info.IsDir() && r.Method == http.MethodDelete:
-		err := os.Remove(osPath)
+	case perms.delete && r.Method == http.MethodDelete && osPath == f.path:
+		_ = f.serveStatus(w, r, http.StatusForbidden)
+	case perms.delete && r.Method == http.MethodDelete:
+		err := f.remove(r, osPath, info)
 		if err != nil {
+			log.Println("delete:", err)
 			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
 		}
 	case info.IsDir():
-		err := f.serveDir(w, r, osPath)
+		err := f.serveDir(w, r, osPath, perms)
 		if err != nil {
 			log.Println(err)
 			w.Write([]byte(err.Error() + "  "))
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+const (
+	previewKey = "preview"
+
+	// previewMaxSize is the largest text file rendered in a preview
+	previewMaxSize = 2 << 20
+	// previewMaxRows is the number of CSV rows shown in a preview
+	previewMaxRows = 1000
+	previewStyle   = "github"
+
+	previewMarkdown = "markdown"
+	previewCode     = "code"
+	previewText     = "text"
+	previewTable    = "table"
+	previewImage    = "image"
+	previewPDF      = "pdf"
+	previewVideo    = "video"
+	previewAudio    = "audio"
+	previewNone     = "none"
+)
+
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+type previewData struct {
+	Title      string
+	Name       string
+	Kind       string
+	RawURL     string
+	ListingURL string
+	Size       fileSizeBytes
+	// HTML is the rendered Markdown or code, CSS the style of the code.
+	HTML template.HTML
+	CSS  template.CSS
+	// Rows of a CSV or TSV file, the first one is the header.
+	Rows      [][]string
+	Truncated bool
+}
+
+// previewKind returns how a file is shown, from its name alone. Files that
+// need a look at their content return previewText.
+func previewKind(name string) string {
+	switch ext := strings.ToLower(path.Ext(name)); {
+	case ext == ".md" || ext == ".markdown":
+		return previewMarkdown
+	case ext == ".csv" || ext == ".tsv":
+		return previewTable
+	case ext == ".pdf":
+		return previewPDF
+	case ext == ".svg" || isImage(name):
+		return previewImage
+	case ext == ".mp4" || ext == ".webm" || ext == ".ogv" || ext == ".mov" || ext == ".m4v":
+		return previewVideo
+	case ext == ".mp3" || ext == ".ogg" || ext == ".oga" || ext == ".wav" || ext == ".flac" || ext == ".m4a" || ext == ".opus":
+		return previewAudio
+	}
+	return previewText
+}
+
+// highlight renders source code as HTML with the lexer for name.
+func highlight(name string, source []byte) (template.HTML, template.CSS, error) {
+	lexer := lexers.Match(name)
+	if lexer == nil {
+		return "", "", nil
+	}
+	lexer = chroma.Coalesce(lexer)
+	style := styles.Get(previewStyle)
+	formatter := chromahtml.New(chromahtml.WithClasses(true), chromahtml.WithLineNumbers(true), chromahtml.WithLinkableLineNumbers(true, "L"))
+	iterator, err := lexer.Tokenise(nil, string(source))
+	if err != nil {
+		return "", "", err
+	}
+	var out, css bytes.Buffer
+	if err := formatter.Format(&out, style, iterator); err != nil {
+		return "", "", err
+	}
+	if err := formatter.WriteCSS(&css, style); err != nil {
+		return "", "", err
+	}
+	return template.HTML(out.String()), template.CSS(css.String()), nil
+}
+
+// readTable reads the first rows of a CSV or TSV file.
+func readTable(r io.Reader, tsv bool) ([][]string, bool, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	if tsv {
+		reader.Comma = '\t'
+	}
+	var rows [][]string
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return rows, false, nil
+		} else if err != nil {
+			return rows, false, err
+		}
+		if len(rows) == previewMaxRows+1 {
+			return rows, true, nil
+		}
+		rows = append(rows, row)
+	}
+}
+
+// readText reads a text file for a preview. It returns false for binary
+// files and files too large to preview.
+func readText(osPath string, info os.FileInfo) ([]byte, bool, error) {
+	if info.Size() > previewMaxSize {
+		return nil, false, nil
+	}
+	b, err := os.ReadFile(osPath)
+	if err != nil {
+		return nil, false, err
+	}
+	sniff := b
+	if len(sniff) > binarySniff {
+		sniff = sniff[:binarySniff]
+	}
+	return b, bytes.IndexByte(sniff, 0) < 0, nil
+}
+
+// servePreview answers GET ?preview with a page that shows the file:
+// Markdown as HTML, source code highlighted, CSV as a table and PDFs,
+// images, video and audio embedded. The plain URL still serves the file.
+func (f *FileHandler) servePreview(w http.ResponseWriter, r *http.Request, osPath string, info os.FileInfo) error {
+	relPath, _ := filepath.Rel(f.path, osPath)
+	data := previewData{
+		Title:      strings.Replace(path.Join(filepath.Base(f.path), relPath), "\\", "/", -1),
+		Name:       info.Name(),
+		Kind:       previewKind(info.Name()),
+		RawURL:     (&url.URL{Path: r.URL.Path}).String(),
+		ListingURL: (&url.URL{Path: path.Dir(r.URL.Path) + "/"}).String(),
+		Size:       fileSizeBytes(info.Size()),
+	}
+
+	switch data.Kind {
+	case previewMarkdown, previewText:
+		text, ok, err := readText(osPath, info)
+		if err != nil {
+			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+			return err
+		}
+		if !ok {
+			data.Kind = previewNone
+			break
+		}
+		if data.Kind == previewMarkdown {
+			var out bytes.Buffer
+			if err := markdown.Convert(text, &out); err != nil {
+				_ = f.serveStatus(w, r, http.StatusInternalServerError)
+				return err
+			}
+			data.HTML = template.HTML(out.String())
+			break
+		}
+		data.HTML, data.CSS, err = highlight(info.Name(), text)
+		if err != nil {
+			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+			return err
+		}
+		if data.HTML != "" {
+			data.Kind = previewCode
+		} else {
+			data.HTML = template.HTML("<pre>" + template.HTMLEscapeString(string(text)) + "</pre>")
+		}
+	case previewTable:
+		file, err := os.Open(osPath)
+		if err != nil {
+			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+			return err
+		}
+		defer file.Close()
+		data.Rows, data.Truncated, err = readTable(file, strings.EqualFold(path.Ext(info.Name()), ".tsv"))
+		if err != nil && len(data.Rows) == 0 {
+			data.Kind = previewNone
+		}
+	}
+
+	tmpl := previewTemplate
+	if f.customTemplate != "" {
+		if custom, e := template.ParseFiles(f.customTemplate + osPathSeparator + "preview.html"); e == nil {
+			tmpl = custom
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return tmpl.Execute(w, data)
+}
@@ -0,0 +1,520 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	quotaDirName = "quotas"
+	// quotaTTL is how long the measured usage of a route is trusted before
+	// it is measured again, for changes that did not go through the server
+	quotaTTL = time.Minute
+	// anyUser is the key of user-quotas for users without their own quota
+	anyUser = "*"
+)
+
+var (
+	errQuota        = errors.New("quota exceeded")
+	errFileTooLarge = errors.New("file too large")
+)
+
+// Quota limits the bytes and files stored, 0 for no limit.
+type Quota struct {
+	Bytes int64 `json:"bytes" yaml:"bytes" toml:"bytes"`
+	Files int64 `json:"files" yaml:"files" toml:"files"`
+}
+
+// quotaFile is a file in the ledger of user uploads.
+type quotaFile struct {
+	User string `json:"user"`
+	Size int64  `json:"size"`
+}
+
+// quotaStatus is the usage shown in listings, of the route or of the user,
+// whichever has less left.
+type quotaStatus struct {
+	User     string        `json:"user,omitempty"`
+	Used     fileSizeBytes `json:"used"`
+	Limit    fileSizeBytes `json:"limit,omitempty"`
+	Left     fileSizeBytes `json:"left,omitempty"`
+	Files    int64         `json:"files"`
+	MaxFiles int64         `json:"max_files,omitempty"`
+}
+
+// quotaCharge is what writing one file costs: replaced is the size of the
+// file it overwrites, files is 1 for a new file. held is what the upload
+// has reserved so far, shared by the copies of the charge.
+type quotaCharge struct {
+	user     string
+	replaced int64
+	files    int64
+	held     *quotaReservation
+}
+
+// quotaReservation is what uploads in progress hold of the quotas, so
+// parallel uploads cannot together write more than is left.
+type quotaReservation struct {
+	bytes, files int64
+}
+
+// quotas keeps the usage of a route and of its users. Files count for the
+// user who uploaded them; the ledger of who uploaded what is kept in the
+// state directory.
+type quotas struct {
+	mu      sync.Mutex
+	root    string
+	route   Quota
+	users   map[string]Quota
+	ledger  string
+	measure func() (int64, int64)
+
+	size, files int64
+	measured    time.Time
+	// owners maps files, relative to root with slashes, to their uploader
+	owners map[string]quotaFile
+	// reserved is what uploads in progress hold, in total and by user
+	reserved     quotaReservation
+	userReserved map[string]quotaReservation
+}
+
+func newQuotas(root, ledger string, route Quota, users map[string]Quota, measure func() (int64, int64)) *quotas {
+	q := &quotas{
+		root:    root,
+		route:   route,
+		users:   users,
+		ledger:  ledger,
+		measure: measure,
+		owners:  make(map[string]quotaFile),
+
+		userReserved: make(map[string]quotaReservation),
+	}
+	if len(users) > 0 {
+		b, err := os.ReadFile(ledger)
+		if err == nil {
+			err = json.Unmarshal(b, &q.owners)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("quota: %q: %v", ledger, err)
+		}
+	}
+	return q
+}
+
+func (q *quotas) userQuota(user string) (Quota, bool) {
+	if quota, ok := q.users[user]; ok {
+		return quota, true
+	}
+	quota, ok := q.users[anyUser]
+	return quota, ok
+}
+
+// usage returns the bytes and files in the route. q.mu must be held.
+func (q *quotas) usage() (int64, int64) {
+	if time.Since(q.measured) > quotaTTL {
+		q.size, q.files = q.measure()
+		q.measured = time.Now()
+	}
+	return q.size, q.files
+}
+
+// userUsage returns the bytes and files user uploaded that still exist.
+// q.mu must be held.
+func (q *quotas) userUsage(user string) (size, files int64) {
+	for rel, file := range q.owners {
+		if file.User != user {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(q.root, filepath.FromSlash(rel)))
+		if err != nil || !info.Mode().IsRegular() {
+			delete(q.owners, rel)
+			continue
+		}
+		file.Size = info.Size()
+		q.owners[rel] = file
+		size += file.Size
+		files++
+	}
+	return size, files
+}
+
+// left returns how many bytes c may write, -1 for no limit, or errQuota if
+// the route or the user is out of space or files.
+func (q *quotas) left(c quotaCharge) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.leftLocked(c)
+}
+
+// leftLocked is left with what uploads in progress hold counted as used.
+// q.mu must be held.
+func (q *quotas) leftLocked(c quotaCharge) (int64, error) {
+	left := int64(-1)
+	check := func(quota Quota, size, files int64, who string) error {
+		if quota.Files > 0 && files+c.files > quota.Files {
+			return fmt.Errorf("%w: %s may keep at most %d files", errQuota, who, quota.Files)
+		}
+		if quota.Bytes > 0 {
+			n := quota.Bytes - size + c.replaced
+			if n <= 0 {
+				return fmt.Errorf("%w: %s uses %s of %s", errQuota, who, fileSizeBytes(size), fileSizeBytes(quota.Bytes))
+			}
+			if left < 0 || n < left {
+				left = n
+			}
+		}
+		return nil
+	}
+	size, files := q.usage()
+	if err := check(q.route, size+q.reserved.bytes, files+q.reserved.files, "the route"); err != nil {
+		return 0, err
+	}
+	if quota, ok := q.userQuota(c.user); ok {
+		size, files := q.userUsage(c.user)
+		held := q.userReserved[c.user]
+		if err := check(quota, size+held.bytes, files+held.files, fmt.Sprintf("user %q", c.user)); err != nil {
+			return 0, err
+		}
+	}
+	return left, nil
+}
+
+// reserve holds n more bytes for the upload of c, and its file the first
+// time, or fails with errQuota if they do not fit.
+func (q *quotas) reserve(c quotaCharge, n int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending := c
+	pending.files -= c.held.files
+	left, err := q.leftLocked(pending)
+	if err != nil {
+		return err
+	}
+	if left >= 0 && n > left {
+		return fmt.Errorf("%w: the upload is larger than the %s left", errQuota, fileSizeBytes(left))
+	}
+	q.hold(c.user, quotaReservation{bytes: n, files: pending.files})
+	c.held.bytes += n
+	c.held.files += pending.files
+	return nil
+}
+
+// hold adds r to what the uploads of user hold. q.mu must be held.
+func (q *quotas) hold(user string, r quotaReservation) {
+	q.reserved.bytes += r.bytes
+	q.reserved.files += r.files
+	held := q.userReserved[user]
+	held.bytes += r.bytes
+	held.files += r.files
+	if held == (quotaReservation{}) {
+		delete(q.userReserved, user)
+	} else {
+		q.userReserved[user] = held
+	}
+}
+
+// release gives back what the upload of c holds. q.mu must be held.
+func (q *quotas) release(c quotaCharge) {
+	if c.held == nil {
+		return
+	}
+	q.hold(c.user, quotaReservation{bytes: -c.held.bytes, files: -c.held.files})
+	*c.held = quotaReservation{}
+}
+
+// record counts n bytes written to the file saved by c, in place of what
+// it held.
+func (q *quotas) record(c quotaCharge, saved string, n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.release(c)
+	q.size += n - c.replaced
+	q.files += c.files
+	if len(q.users) == 0 {
+		return
+	}
+	rel, err := filepath.Rel(q.root, saved)
+	if err != nil {
+		return
+	}
+	q.owners[filepath.ToSlash(rel)] = quotaFile{User: c.user, Size: n}
+	q.save()
+}
+
+// add counts files that are not owned by anybody, such as copies, if they
+// fit into what is left for user.
+func (q *quotas) add(user string, size, files int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	left, err := q.leftLocked(quotaCharge{user: user, files: files})
+	if err == nil && left >= 0 && size > left {
+		err = fmt.Errorf("%w: the copy needs %s, %s are left", errQuota, fileSizeBytes(size), fileSizeBytes(left))
+	}
+	if err != nil {
+		return err
+	}
+	q.size += size
+	q.files += files
+	return nil
+}
+
+// move keeps the uploader of files that were renamed or moved from src to
+// dst.
+func (q *quotas) move(src, dst string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.users) == 0 {
+		return
+	}
+	src, errSrc := filepath.Rel(q.root, src)
+	dst, errDst := filepath.Rel(q.root, dst)
+	if errSrc != nil || errDst != nil {
+		return
+	}
+	src, dst = filepath.ToSlash(src), filepath.ToSlash(dst)
+	moved := make(map[string]quotaFile)
+	for rel, file := range q.owners {
+		if within(src, rel) {
+			delete(q.owners, rel)
+			moved[dst+rel[len(src):]] = file
+		}
+	}
+	for rel, file := range moved {
+		q.owners[rel] = file
+	}
+	q.save()
+}
+
+// save writes the ledger. q.mu must be held.
+func (q *quotas) save() {
+	b, err := json.Marshal(q.owners)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(q.ledger), 0700)
+	}
+	if err == nil {
+		err = os.WriteFile(q.ledger+".tmp", b, 0600)
+	}
+	if err == nil {
+		err = os.Rename(q.ledger+".tmp", q.ledger)
+	}
+	if err != nil {
+		log.Printf("quota: %q: %v", q.ledger, err)
+	}
+}
+
+// status returns the usage of the route or of user, whichever has less
+// left, or nil if neither has a quota.
+func (q *quotas) status(user string) *quotaStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var out *quotaStatus
+	add := func(quota Quota, size, files int64, user string) {
+		if quota == (Quota{}) {
+			return
+		}
+		s := &quotaStatus{User: user, Used: fileSizeBytes(size), Limit: fileSizeBytes(quota.Bytes), Files: files, MaxFiles: quota.Files}
+		if quota.Bytes > size {
+			s.Left = fileSizeBytes(quota.Bytes - size)
+		}
+		if out == nil || out.Limit == 0 || s.Limit > 0 && s.Left < out.Left {
+			out = s
+		}
+	}
+	size, files := q.usage()
+	add(q.route, size, files, "")
+	if quota, ok := q.userQuota(user); ok {
+		size, files := q.userUsage(user)
+		add(quota, size, files, user)
+	}
+	return out
+}
+
+// quotaReader fails with err once more than n bytes are read from r, or
+// when reserve refuses what was read, so uploads are stopped while they
+// stream in.
+type quotaReader struct {
+	r        io.Reader
+	n        int64
+	err      error
+	reserve  func(n int64) error
+	exceeded bool
+}
+
+func (l *quotaReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		n, l.n, l.exceeded = int(l.n), 0, true
+		return n, l.err
+	}
+	if l.reserve != nil && n > 0 {
+		if rerr := l.reserve(int64(n)); rerr != nil {
+			l.n, l.err, l.exceeded = 0, rerr, true
+			return 0, rerr
+		}
+	}
+	l.n -= int64(n)
+	return n, err
+}
+
+// measure returns the bytes and files in the route, from the index if the
+// route has one.
+func (f *FileHandler) measure() (int64, int64) {
+	if f.index != nil {
+		if size, files, ok := f.index.treeSize(f.path); ok {
+			return size, files
+		}
+	}
+	size, files, err := treeSize(f.path)
+	if err != nil {
+		log.Printf("quota: %v", err)
+	}
+	return size, files
+}
+
+// quotaCharge returns what writing dst costs for the request.
+func (f *FileHandler) quotaCharge(r *http.Request, dst string) quotaCharge {
+	c := quotaCharge{user: requestUser(r), files: 1}
+	info, err := os.Lstat(dst)
+	if err != nil {
+		return c
+	}
+	switch f.conflict {
+	case conflictOverwrite:
+		c.replaced, c.files = info.Size(), 0
+	case conflictVersions:
+		// the old file moves to .versions and still counts
+		c.files = 1
+	}
+	return c
+}
+
+// uploadLeft returns how many bytes c may write, -1 for no limit: the
+// smallest of the file size limit and the quotas of route and user.
+func (f *FileHandler) uploadLeft(c quotaCharge) (int64, error) {
+	left := f.maxFileSize
+	if left <= 0 {
+		left = -1
+	}
+	if f.quotas == nil {
+		return left, nil
+	}
+	n, err := f.quotas.left(c)
+	if err != nil {
+		return 0, err
+	}
+	if n >= 0 && (left < 0 || n < left) {
+		left = n
+	}
+	return left, nil
+}
+
+// limitUpload limits body to what the request may write to dst. The bytes
+// are reserved in the quotas as they are read, until recordUpload counts
+// the file or releaseUpload gives them back.
+func (f *FileHandler) limitUpload(r *http.Request, dst string, body io.Reader) (io.Reader, quotaCharge, error) {
+	c := f.quotaCharge(r, dst)
+	left, err := f.uploadLeft(c)
+	if err != nil {
+		return body, c, err
+	}
+	l := &quotaReader{r: body, n: left}
+	if left < 0 {
+		if f.quotas == nil {
+			return body, c, nil
+		}
+		l.n = math.MaxInt64 - 1
+	}
+	if f.maxFileSize > 0 && left == f.maxFileSize {
+		l.err = fmt.Errorf("%w: files may be at most %s", errFileTooLarge, fileSizeBytes(left))
+	} else {
+		l.err = fmt.Errorf("%w: the upload is larger than the %s left", errQuota, fileSizeBytes(left))
+	}
+	if f.quotas != nil {
+		c.held = &quotaReservation{}
+		if err := f.quotas.reserve(c, 0); err != nil {
+			return body, c, err
+		}
+		l.reserve = func(n int64) error { return f.quotas.reserve(c, n) }
+	}
+	return l, c, nil
+}
+
+// checkUpload returns an error if the request may not write size bytes to
+// dst, for uploads whose size is known in advance.
+func (f *FileHandler) checkUpload(r *http.Request, dst string, size int64) error {
+	if f.maxFileSize > 0 && size > f.maxFileSize {
+		return fmt.Errorf("%w: files may be at most %s", errFileTooLarge, fileSizeBytes(f.maxFileSize))
+	}
+	left, err := f.uploadLeft(f.quotaCharge(r, dst))
+	if err == nil && left >= 0 && size > left {
+		err = fmt.Errorf("%w: %s is larger than the %s left", errQuota, fileSizeBytes(size), fileSizeBytes(left))
+	}
+	return err
+}
+
+// checkCopy returns an error if a copy of size bytes in files files does
+// not fit into the quotas, and counts it for the route otherwise.
+func (f *FileHandler) checkCopy(r *http.Request, size, files int64) error {
+	if f.quotas == nil {
+		return nil
+	}
+	return f.quotas.add(requestUser(r), size, files)
+}
+
+// recordUpload counts a file of n bytes saved at saved.
+func (f *FileHandler) recordUpload(c quotaCharge, saved string, n int64) {
+	if f.quotas != nil {
+		f.quotas.record(c, saved, n)
+	}
+}
+
+// releaseUpload gives back what an upload that was not saved reserved. It
+// does nothing after recordUpload.
+func (f *FileHandler) releaseUpload(c quotaCharge) {
+	if f.quotas != nil {
+		f.quotas.mu.Lock()
+		defer f.quotas.mu.Unlock()
+		f.quotas.release(c)
+	}
+}
+
+// isTooLarge reports whether err should be answered with 413.
+func isTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge) || errors.Is(err, errQuota) || errors.Is(err, errFileTooLarge) || errors.Is(err, errExtractLimit)
+}
+
+// serveTooLarge answers 413 with a page that tells why, errors/413.html of
+// the custom templates if there is one.
+func (f *FileHandler) serveTooLarge(w http.ResponseWriter, r *http.Request, err error) {
+	data := struct {
+		Message    string
+		ListingURL string
+	}{Message: err.Error(), ListingURL: r.URL.Path}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		data.Message = fmt.Sprintf("The request is larger than the %s allowed.", fileSizeBytes(tooLarge.Limit))
+	}
+	tmpl := tooLargeTemplate
+	if f.customTemplate != "" {
+		if custom, e := template.ParseFiles(f.customTemplate + osPathSeparator + "errors" + osPathSeparator + "413.html"); e == nil {
+			tmpl = custom
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	_ = tmpl.Execute(w, data)
+}
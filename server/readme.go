@@ -0,0 +1,53 @@
+package server
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// splitNames splits a comma separated list of file names.
+func splitNames(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// renderReadme renders the first of names that exists in the folder
+// osPath: Markdown files as HTML, anything else as plain text.
+func (f *FileHandler) renderReadme(osPath string, names []string) template.HTML {
+	for _, name := range names {
+		p := filepath.Join(osPath, filepath.Base(name))
+		info, err := os.Stat(p)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		text, ok, err := readText(p, info)
+		if err != nil {
+			log.Println("readme:", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".md", ".markdown":
+			var out bytes.Buffer
+			if err := markdown.Convert(text, &out); err != nil {
+				log.Println("readme:", err)
+				continue
+			}
+			return template.HTML(out.String())
+		default:
+			return template.HTML("<pre>" + template.HTMLEscapeString(string(text)) + "</pre>")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	renameKey = "rename"
+	toKey     = "to"
+)
+
+var (
+	errOutsideRoute = errors.New("destination is outside of the route")
+	errExists       = errors.New("destination already exists")
+)
+
+// within reports whether p is root or below it.
+func within(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+osPathSeparator)
+}
+
+// withinNoLinks is within for paths on disk: none of the existing folders
+// between root and p may be a symbolic link, which could lead out of root.
+// p itself is not resolved.
+func withinNoLinks(root, p string) bool {
+	if !within(root, p) {
+		return false
+	}
+	if p == root {
+		return true
+	}
+	rel, _ := filepath.Rel(root, filepath.Dir(p))
+	if rel == "." {
+		return true
+	}
+	dir := root
+	for _, elem := range strings.Split(rel, osPathSeparator) {
+		dir = filepath.Join(dir, elem)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return true
+		} else if err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// destination resolves the target of a rename, move or copy of osPath.
+// A name without '/' stays in the same folder, a path starting with '/'
+// is taken from the route root, anything else from the folder of osPath.
+func (f *FileHandler) destination(osPath, to string) (string, error) {
+	to = strings.TrimSpace(to)
+	if to == "" || to == "." || to == ".." {
+		return "", fmt.Errorf("invalid destination %q", to)
+	}
+	var dst string
+	if strings.HasPrefix(to, "/") {
+		dst = filepath.Join(f.path, filepath.FromSlash(path.Clean(to)))
+	} else {
+		dst = filepath.Join(filepath.Dir(osPath), filepath.FromSlash(to))
+	}
+	if !withinNoLinks(f.path, dst) || dst == f.path {
+		return "", errOutsideRoute
+	}
+	return dst, nil
+}
+
+// headerDestination resolves the Destination header of MOVE and COPY requests.
+func (f *FileHandler) headerDestination(r *http.Request) (string, error) {
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || u.Path == "" {
+		return "", fmt.Errorf("invalid Destination header")
+	}
+	if !strings.HasPrefix(u.Path, f.route) {
+		return "", errOutsideRoute
+	}
+	return f.destination(f.path, "/"+strings.TrimPrefix(u.Path, f.route))
+}
+
+// checkMove validates moving or copying src to dst.
+func checkMove(src, dst string) error {
+	if src == dst {
+		return fmt.Errorf("source and destination are the same")
+	}
+	if within(src, dst) {
+		return fmt.Errorf("cannot move or copy a folder into itself")
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return errExists
+	}
+	if info, err := os.Stat(filepath.Dir(dst)); err != nil || !info.IsDir() {
+		return fmt.Errorf("destination folder does not exist")
+	}
+	return nil
+}
+
+// serveRename handles POST ?rename (form field "to") and MOVE (Destination header).
+func (f *FileHandler) serveRename(w http.ResponseWriter, r *http.Request, osPath string) error {
+	if osPath == f.path || !withinNoLinks(f.path, osPath) {
+		return f.serveStatus(w, r, http.StatusForbidden)
+	}
+	var dst string
+	var err error
+	if r.Method == "MOVE" {
+		dst, err = f.headerDestination(r)
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return f.serveStatus(w, r, http.StatusBadRequest)
+		}
+		dst, err = f.destination(osPath, r.FormValue(toKey))
+	}
+	switch {
+	case errors.Is(err, errOutsideRoute):
+		return f.serveStatus(w, r, http.StatusForbidden)
+	case err != nil:
+		return f.serveStatus(w, r, http.StatusBadRequest)
+	case !f.permissions(r, dst).rename:
+		return f.serveStatus(w, r, http.StatusForbidden)
+	}
+	if err := checkMove(osPath, dst); errors.Is(err, errExists) {
+		return f.serveStatus(w, r, http.StatusConflict)
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return err
+	}
+
+	if err := os.Rename(osPath, dst); err != nil {
+		_ = f.serveStatus(w, r, http.StatusInternalServerError)
+		return err
+	}
+	log.Printf("renamed %q to %q", osPath, dst)
+	if f.quotas != nil {
+		f.quotas.move(osPath, dst)
+	}
+
+	if r.Method == "MOVE" {
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	}
+	rel, _ := filepath.Rel(f.path, filepath.Dir(dst))
+	u := url.URL{Path: path.Join(f.route, filepath.ToSlash(rel)) + "/"}
+	w.Header().Set("Location", u.String())
+	w.WriteHeader(http.StatusSeeOther)
+	return nil
+}
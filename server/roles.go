@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+type role int
+
+const (
+	roleReader role = iota
+	roleUploader
+	roleEditor
+	roleAdmin
+)
+
+var roleNames = map[string]role{
+	"reader":   roleReader,
+	"uploader": roleUploader,
+	"editor":   roleEditor,
+	"admin":    roleAdmin,
+}
+
+func parseRole(name string) (role, error) {
+	r, ok := roleNames[strings.ToLower(name)]
+	if !ok {
+		return roleReader, fmt.Errorf("unknown role %q, use reader, uploader, editor or admin", name)
+	}
+	return r, nil
+}
+
+// RoleRule gives the listed users and groups a role below Path. A rule
+// without users and groups applies to everybody.
+type RoleRule struct {
+	Path   string   `json:"path" yaml:"path" toml:"path"`
+	Users  []string `json:"users" yaml:"users" toml:"users"`
+	Groups []string `json:"groups" yaml:"groups" toml:"groups"`
+	Role   string   `json:"role" yaml:"role" toml:"role"`
+
+	role role
+}
+
+// permissions are the write operations allowed for a request.
+type permissions struct {
+	upload bool
+	delete bool
+	create bool
+	rename bool
+}
+
+// permissions returns what a role may do at most.
+func (r role) permissions() permissions {
+	return permissions{
+		upload: r >= roleUploader,
+		delete: r >= roleEditor,
+		create: r >= roleEditor,
+		rename: r >= roleEditor,
+	}
+}
+
+func (p permissions) and(o permissions) permissions {
+	return permissions{
+		upload: p.upload && o.upload,
+		delete: p.delete && o.delete,
+		create: p.create && o.create,
+		rename: p.rename && o.rename,
+	}
+}
+
+type userContextKey struct{}
+
+// requestUser returns the name the request was authenticated with.
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userContextKey{}).(string)
+	return user
+}
+
+func withUser(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey{}, user))
+}
+
+func (rule RoleRule) matches(user string, groups []string) bool {
+	if len(rule.Users) == 0 && len(rule.Groups) == 0 {
+		return true
+	}
+	for _, u := range rule.Users {
+		if u == user {
+			return true
+		}
+	}
+	for _, g := range groups {
+		for _, allowed := range rule.Groups {
+			if g == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prepareRules checks the role names and normalizes the paths of rules.
+func prepareRules(rules []RoleRule) error {
+	for i := range rules {
+		var err error
+		rules[i].role, err = parseRole(rules[i].Role)
+		if err != nil {
+			return err
+		}
+		rules[i].Path = normalizeRoute(rules[i].Path)
+	}
+	return nil
+}
+
+// role returns the role of the request user at relPath ("/dir/file"),
+// taken from the matching rule with the longest path.
+func (f *FileHandler) role(r *http.Request, relPath string) role {
+	user := requestUser(r)
+	var groups []string
+	if f.htpasswd != nil && user != "" {
+		groups = f.htpasswd.Groups(user)
+	}
+	result, longest := f.defaultRole, -1
+	for _, rule := range f.rules {
+		if !strings.HasPrefix(relPath, rule.Path) && relPath+"/" != rule.Path {
+			continue
+		}
+		if len(rule.Path) > longest && rule.matches(user, groups) {
+			result, longest = rule.role, len(rule.Path)
+		}
+	}
+	return result
+}
+
+// permissions returns the operations the request may do on osPath: the
+// permissions of the route limited by the role of the user.
+func (f *FileHandler) permissions(r *http.Request, osPath string) permissions {
+	p := permissions{upload: f.allowUpload, delete: f.allowDelete, create: f.allowCreate, rename: f.allowRename}
+	if len(f.rules) == 0 && f.defaultRole == roleAdmin {
+		return p
+	}
+	relPath, err := filepath.Rel(f.path, osPath)
+	if err != nil {
+		return permissions{}
+	}
+	if relPath == "." {
+		relPath = ""
+	}
+	relPath = "/" + filepath.ToSlash(relPath)
+	return p.and(f.role(r, relPath).permissions())
+}
@@ -6,16 +6,58 @@ import (
 	"strings"
 )
 
+// Route is a single route definition. Settings left nil or empty fall back
+// to the global values of Config.
+type Route struct {
+	Route  string `json:"route" yaml:"route" toml:"route"`
+	Path   string `json:"path" yaml:"path" toml:"path"`
+	User   string `json:"user" yaml:"user" toml:"user"`
+	Passwd string `json:"passwd" yaml:"passwd" toml:"passwd"`
+	// Users and Groups limit the route to these users of the htpasswd file.
+	Users  []string `json:"users" yaml:"users" toml:"users"`
+	Groups []string `json:"groups" yaml:"groups" toml:"groups"`
+
+	AllowUploads  *bool `json:"uploads" yaml:"uploads" toml:"uploads"`
+	AllowDeletes  *bool `json:"deletes" yaml:"deletes" toml:"deletes"`
+	AllowCreates  *bool `json:"creates" yaml:"creates" toml:"creates"`
+	AllowRenames  *bool `json:"renames" yaml:"renames" toml:"renames"`
+	NoAllowHidden *bool `json:"nohidden" yaml:"nohidden" toml:"nohidden"`
+	WebDAV        *bool `json:"webdav" yaml:"webdav" toml:"webdav"`
+	Index         *bool `json:"index" yaml:"index" toml:"index"`
+	DirSizes      *bool `json:"dir-sizes" yaml:"dir-sizes" toml:"dir-sizes"`
+	ChecksumFiles *bool `json:"checksum-files" yaml:"checksum-files" toml:"checksum-files"`
+	// Header and Footer are comma separated file names shown above and
+	// below listings, "" shows none.
+	Header *string `json:"header" yaml:"header" toml:"header"`
+	Footer *string `json:"footer" yaml:"footer" toml:"footer"`
+	// Conflict is what uploads do with existing files: overwrite, reject,
+	// rename or versions.
+	Conflict      *string           `json:"conflict" yaml:"conflict" toml:"conflict"`
+	Templates     string            `json:"templates" yaml:"templates" toml:"templates"`
+	MaxUploadSize *int64            `json:"max-upload-size" yaml:"max-upload-size" toml:"max-upload-size"`
+	Headers       map[string]string `json:"headers" yaml:"headers" toml:"headers"`
+	// Rules map users to roles below paths of the route, DefaultRole applies
+	// where no rule matches and defaults to admin.
+	Rules       []RoleRule `json:"rules" yaml:"rules" toml:"rules"`
+	DefaultRole string     `json:"default-role" yaml:"default-role" toml:"default-role"`
+	// Trash is the folder deleted items are moved to, TrashRetention how
+	// long they are kept there ("720h", "30d").
+	Trash          string `json:"trash" yaml:"trash" toml:"trash"`
+	TrashRetention string `json:"trash-retention" yaml:"trash-retention" toml:"trash-retention"`
+	// Quota and QuotaFiles limit the bytes and files in the route,
+	// UserQuotas what each user ("*" for everybody else) may upload, and
+	// MaxFileSize single files.
+	Quota       *int64           `json:"quota" yaml:"quota" toml:"quota"`
+	QuotaFiles  *int64           `json:"quota-files" yaml:"quota-files" toml:"quota-files"`
+	UserQuotas  map[string]Quota `json:"user-quotas" yaml:"user-quotas" toml:"user-quotas"`
+	MaxFileSize *int64           `json:"max-file-size" yaml:"max-file-size" toml:"max-file-size"`
+}
+
 type Routes struct {
 	Separator string
 
-	Values []struct {
-		Route  string
-		Path   string
-		User   string
-		Passwd string
-	}
-	Texts []string
+	Values []Route
+	Texts  []string
 }
 
 func (fv *Routes) Help() string {
@@ -54,6 +96,17 @@ func getAuth(v string) (s, u, p string) {
 	return s, "", ""
 }
 
+// normalizeRoute makes route start and end with '/'
+func normalizeRoute(route string) string {
+	if !strings.HasPrefix(route, "/") {
+		route = "/" + route
+	}
+	if !strings.HasSuffix(route, "/") {
+		route = route + "/"
+	}
+	return route
+}
+
 // Set is flag.Value.Set
 func (fv *Routes) Set(v string) error {
 	separator := "="
@@ -79,20 +132,10 @@ func (fv *Routes) Set(v string) error {
 		if err != nil {
 			return err
 		}
-		if !strings.HasPrefix(route, "/") {
-			route = "/" + route
-		}
-		if !strings.HasSuffix(route, "/") {
-			route = route + "/"
-		}
+		route = normalizeRoute(route)
 	}
 	fv.Texts = append(fv.Texts, v)
-	fv.Values = append(fv.Values, struct {
-		Route  string
-		Path   string
-		User   string
-		Passwd string
-	}{
+	fv.Add(Route{
 		Route:  route,
 		Path:   path,
 		User:   user,
@@ -101,6 +144,22 @@ func (fv *Routes) Set(v string) error {
 	return nil
 }
 
+// Add appends a route. A route that is already defined gets the path and
+// credentials of the new definition and keeps its other settings.
+func (fv *Routes) Add(route Route) {
+	for i := range fv.Values {
+		if fv.Values[i].Route != route.Route {
+			continue
+		}
+		fv.Values[i].Path = route.Path
+		if route.User != "" && route.Passwd != "" {
+			fv.Values[i].User, fv.Values[i].Passwd = route.User, route.Passwd
+		}
+		return
+	}
+	fv.Values = append(fv.Values, route)
+}
+
 func (fv *Routes) String() string {
 	return strings.Join(fv.Texts, ", ")
 }
@@ -0,0 +1,348 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	searchKey   = "search"
+	nameKey     = "name"
+	regexKey    = "regex"
+	textKey     = "text"
+	minSizeKey  = "min-size"
+	maxSizeKey  = "max-size"
+	afterKey    = "after"
+	beforeKey   = "before"
+	typeKey     = "type"
+	typeFile    = "file"
+	typeDir     = "dir"
+	dateLayout  = "2006-01-02"
+	binarySniff = 512
+
+	// searchTextMaxSize is the largest file searched for text
+	searchTextMaxSize = 16 << 20
+)
+
+// searchQuery holds the parsed filters of a ?search request. Empty
+// filters match everything.
+type searchQuery struct {
+	Name    string
+	Regex   string
+	Text    string
+	MinSize string
+	MaxSize string
+	After   string
+	Before  string
+	Type    string
+
+	glob    string
+	regex   *regexp.Regexp
+	text    []byte
+	minSize int64
+	maxSize int64
+	after   time.Time
+	before  time.Time
+}
+
+type searchData struct {
+	Title      string
+	Query      searchQuery
+	Files      []directoryListingFileData
+	Truncated  bool
+	ListingURL *url.URL
+}
+
+// jsonSearch is the machine-readable form of searchData.
+type jsonSearch struct {
+	Version   int        `json:"version"`
+	Path      string     `json:"path"`
+	Total     int        `json:"total"`
+	Truncated bool       `json:"truncated"`
+	Files     []jsonFile `json:"files"`
+}
+
+// parseSize parses a size in bytes with an optional k, m, g or t suffix.
+func parseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(size)), "b")
+	shift := 0
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k':
+			shift = 10
+		case 'm':
+			shift = 20
+		case 'g':
+			shift = 30
+		case 't':
+			shift = 40
+		}
+		if shift > 0 {
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(v * float64(int64(1)<<shift)), nil
+}
+
+// namePattern turns a name filter into a lower case glob. Names without
+// wildcards match anywhere in the name.
+func namePattern(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	glob := strings.ToLower(name)
+	if !strings.ContainsAny(glob, "*?[") {
+		glob = "*" + glob + "*"
+	}
+	if _, err := path.Match(glob, ""); err != nil {
+		return "", fmt.Errorf("invalid name pattern %q", name)
+	}
+	return glob, nil
+}
+
+// matchName reports whether name matches a glob from namePattern.
+func matchName(glob, name string) bool {
+	if glob == "" {
+		return true
+	}
+	ok, _ := path.Match(glob, strings.ToLower(name))
+	return ok
+}
+
+// parseDate parses a day (2006-01-02) or an RFC 3339 time.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation(dateLayout, s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid date %q, use YYYY-MM-DD or RFC 3339", s)
+	}
+	return t, nil
+}
+
+func parseSearchQuery(q url.Values) (searchQuery, error) {
+	s := searchQuery{
+		Name:    strings.TrimSpace(q.Get(nameKey)),
+		Regex:   q.Get(regexKey),
+		Text:    q.Get(textKey),
+		MinSize: q.Get(minSizeKey),
+		MaxSize: q.Get(maxSizeKey),
+		After:   q.Get(afterKey),
+		Before:  q.Get(beforeKey),
+		Type:    q.Get(typeKey),
+		maxSize: -1,
+	}
+	var err error
+	if s.glob, err = namePattern(s.Name); err != nil {
+		return s, err
+	}
+	if s.Regex != "" {
+		if s.regex, err = regexp.Compile(s.Regex); err != nil {
+			return s, err
+		}
+	}
+	if s.Text != "" {
+		s.text = bytes.ToLower([]byte(s.Text))
+	}
+	if s.MinSize != "" {
+		if s.minSize, err = parseSize(s.MinSize); err != nil {
+			return s, err
+		}
+	}
+	if s.MaxSize != "" {
+		if s.maxSize, err = parseSize(s.MaxSize); err != nil {
+			return s, err
+		}
+	}
+	if s.After != "" {
+		if s.after, err = parseDate(s.After); err != nil {
+			return s, err
+		}
+	}
+	if s.Before != "" {
+		if s.before, err = parseDate(s.Before); err != nil {
+			return s, err
+		}
+		if len(s.Before) == len(dateLayout) {
+			// a day includes everything modified on it
+			s.before = s.before.AddDate(0, 0, 1)
+		}
+	}
+	switch s.Type {
+	case "", typeFile, typeDir:
+	default:
+		return s, fmt.Errorf("invalid type %q, use file or dir", s.Type)
+	}
+	return s, nil
+}
+
+// empty reports whether the query has no filters at all.
+func (s searchQuery) empty() bool {
+	return s.Name == "" && s.Regex == "" && s.Text == "" && s.MinSize == "" &&
+		s.MaxSize == "" && s.After == "" && s.Before == "" && s.Type == ""
+}
+
+// matches applies every filter except the text search to a walked entry.
+func (s searchQuery) matches(rel string, info os.FileInfo) bool {
+	switch {
+	case s.Type == typeFile && info.IsDir(), s.Type == typeDir && !info.IsDir():
+		return false
+	case s.text != nil && !info.Mode().IsRegular():
+		return false
+	case (s.minSize > 0 || s.maxSize >= 0) && info.IsDir():
+		return false
+	case info.Size() < s.minSize, s.maxSize >= 0 && info.Size() > s.maxSize:
+		return false
+	case !s.after.IsZero() && info.ModTime().Before(s.after):
+		return false
+	case !s.before.IsZero() && !info.ModTime().Before(s.before):
+		return false
+	}
+	if !matchName(s.glob, info.Name()) {
+		return false
+	}
+	return s.regex == nil || s.regex.MatchString(rel)
+}
+
+// containsText reports whether the file at p contains the text of the
+// query, ignoring case. Binary and very large files never match.
+func (s searchQuery) containsText(p string, info os.FileInfo) bool {
+	if info.Size() > searchTextMaxSize {
+		return false
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return false
+	}
+	sniff := b
+	if len(sniff) > binarySniff {
+		sniff = sniff[:binarySniff]
+	}
+	if bytes.IndexByte(sniff, 0) >= 0 {
+		return false
+	}
+	return bytes.Contains(bytes.ToLower(b), s.text)
+}
+
+// search walks osPath and returns the matching entries, at most limit.
+func (f *FileHandler) search(r *http.Request, osPath string, q searchQuery, limit int) ([]directoryListingFileData, bool, error) {
+	var results []directoryListingFileData
+	truncated := false
+	walk := filepath.Walk
+	if f.index != nil {
+		walk = f.index.walk
+	}
+	err := walk(osPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// unreadable folders are left out of the results
+			return nil
+		}
+		if r.Context().Err() != nil {
+			return r.Context().Err()
+		}
+		if p == osPath {
+			return nil
+		}
+		if f.hiddenEntry(p) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(osPath, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !q.matches(rel, info) || q.text != nil && !q.containsText(p, info) {
+			return nil
+		}
+		if len(results) == limit {
+			truncated = true
+			return io.EOF
+		}
+		file := f.fileData(r, filepath.Dir(p), info)
+		file.Name = rel
+		file.URL = &url.URL{Path: path.Join(r.URL.Path, rel)}
+		if info.IsDir() {
+			file.URL.Path += "/"
+		}
+		results = append(results, file)
+		return nil
+	})
+	if err == io.EOF {
+		err = nil
+	}
+	return results, truncated, err
+}
+
+// serveSearch answers GET ?search with the entries below osPath that match
+// the name, regex, text, size, date and type filters of the query.
+func (f *FileHandler) serveSearch(w http.ResponseWriter, r *http.Request, osPath string) error {
+	q, err := parseSearchQuery(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return nil
+	}
+	limit := queryInt(r, limitKey, defaultListingLimit)
+	if limit > maxListingLimit {
+		limit = maxListingLimit
+	}
+	relPath, _ := filepath.Rel(f.path, osPath)
+	title := strings.Replace(path.Join(filepath.Base(f.path), relPath), "\\", "/", -1)
+
+	files, truncated := []directoryListingFileData(nil), false
+	if !q.empty() {
+		files, truncated, err = f.search(r, osPath, q, limit)
+		if err != nil {
+			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+			return err
+		}
+	}
+
+	if wantsJSON(r) {
+		out := jsonSearch{
+			Version:   listingSchemaVersion,
+			Path:      title,
+			Total:     len(files),
+			Truncated: truncated,
+			Files:     make([]jsonFile, 0, len(files)),
+		}
+		for _, file := range files {
+			out.Files = append(out.Files, newJSONFile(file))
+		}
+		return writeJSON(w, http.StatusOK, out)
+	}
+
+	tmpl := searchTemplate
+	if f.customTemplate != "" {
+		if custom, e := template.ParseFiles(f.customTemplate + osPathSeparator + "search.html"); e == nil {
+			tmpl = custom
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return tmpl.Execute(w, searchData{
+		Title:      title,
+		Query:      q,
+		Files:      files,
+		Truncated:  truncated,
+		ListingURL: &url.URL{Path: r.URL.Path},
+	})
+}
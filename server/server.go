@@ -1,38 +1,84 @@
 package server
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type Config struct {
 	AllowCreatesFlag   bool
 	AllowDeletesFlag   bool
+	AllowRenamesFlag   bool
 	AllowUploadsFlag   bool
 	CustomTemplateFlag string
+	HtgroupFlag        string
+	HtpasswdFlag       string
+	HeadersFlag        map[string]string
+	MaxUploadSizeFlag  int64
 	NoAllowHiddenFlag  bool
 	PasswdFlag         string
 	RootRoute          string
 	SslCertificate     string
 	SslKey             string
+	TrashFlag          string
+	TrashRetentionFlag time.Duration
+	StateDirFlag       string
 	Routes             Routes
 	UserFlag           string
+	WebDAVFlag         bool
+	IndexFlag          bool
+	DirSizesFlag       bool
+	ChecksumFilesFlag  bool
+	HeaderFlag         string
+	FooterFlag         string
+	// ExtractMaxSizeFlag and ExtractMaxFilesFlag limit the bytes and
+	// entries one ?extract upload may unpack, 0 for no limit.
+	ExtractMaxSizeFlag  int64
+	ExtractMaxFilesFlag int
+	ConflictFlag        string
+	MaxFileSizeFlag     int64
+	QuotaFlag           int64
+	QuotaFilesFlag      int64
+	UserQuotasFlag      map[string]Quota
 }
 
 func NewConfig() Config {
 	return Config{
-		AllowCreatesFlag:   false,
-		AllowDeletesFlag:   false,
-		AllowUploadsFlag:   false,
-		CustomTemplateFlag: "",
-		NoAllowHiddenFlag:  false,
-		RootRoute:          "/",
-		SslCertificate:     "",
-		SslKey:             "",
-		UserFlag:           "",
-		PasswdFlag:         "",
+		AllowCreatesFlag:    false,
+		AllowDeletesFlag:    false,
+		AllowRenamesFlag:    false,
+		AllowUploadsFlag:    false,
+		CustomTemplateFlag:  "",
+		HtgroupFlag:         "",
+		HtpasswdFlag:        "",
+		HeadersFlag:         nil,
+		MaxUploadSizeFlag:   0,
+		NoAllowHiddenFlag:   false,
+		RootRoute:           "/",
+		SslCertificate:      "",
+		SslKey:              "",
+		TrashFlag:           "",
+		TrashRetentionFlag:  30 * 24 * time.Hour,
+		StateDirFlag:        filepath.Join(os.TempDir(), "http-file-server"),
+		UserFlag:            "",
+		PasswdFlag:          "",
+		WebDAVFlag:          false,
+		IndexFlag:           false,
+		DirSizesFlag:        false,
+		ChecksumFilesFlag:   false,
+		HeaderFlag:          "HEADER.md",
+		FooterFlag:          "README.md",
+		ExtractMaxSizeFlag:  10 << 30,
+		ExtractMaxFilesFlag: 10000,
+		ConflictFlag:        "overwrite",
+		MaxFileSizeFlag:     0,
+		QuotaFlag:           0,
+		QuotaFilesFlag:      0,
+		UserQuotasFlag:      nil,
 	}
 }
 
@@ -40,30 +86,126 @@ func Run(addr string, cfg Config) error {
 	mux := http.DefaultServeMux
 	handlers := make(map[string]http.Handler)
 
+	var htpasswd *Htpasswd
+	if cfg.HtpasswdFlag != "" {
+		var err error
+		htpasswd, err = LoadHtpasswd(cfg.HtpasswdFlag, cfg.HtgroupFlag)
+		if err != nil {
+			return err
+		}
+		log.Printf("loaded users from %q", cfg.HtpasswdFlag)
+	}
+
 	if len(cfg.Routes.Values) == 0 {
 		_ = cfg.Routes.Set(".")
 	}
 
 	for _, route := range cfg.Routes.Values {
-		handlers[route.Route] = &FileHandler{
-			route:          route.Route,
-			path:           route.Path,
-			allowUpload:    cfg.AllowUploadsFlag,
-			allowDelete:    cfg.AllowDeletesFlag,
-			allowCreate:    cfg.AllowCreatesFlag,
-			customTemplate: cfg.CustomTemplateFlag,
-			noAllowHidden:  cfg.NoAllowHiddenFlag,
+		customTemplate := cfg.CustomTemplateFlag
+		if route.Templates != "" {
+			customTemplate = route.Templates
+		}
+		headers := make(map[string]string)
+		for k, v := range cfg.HeadersFlag {
+			headers[k] = v
+		}
+		for k, v := range route.Headers {
+			headers[k] = v
+		}
+		handler := &FileHandler{
+			route:           route.Route,
+			path:            route.Path,
+			allowUpload:     boolOr(route.AllowUploads, cfg.AllowUploadsFlag),
+			allowDelete:     boolOr(route.AllowDeletes, cfg.AllowDeletesFlag),
+			allowCreate:     boolOr(route.AllowCreates, cfg.AllowCreatesFlag),
+			allowRename:     boolOr(route.AllowRenames, cfg.AllowRenamesFlag),
+			customTemplate:  customTemplate,
+			noAllowHidden:   boolOr(route.NoAllowHidden, cfg.NoAllowHiddenFlag),
+			stateDir:        cfg.StateDirFlag,
+			maxUploadSize:   int64Or(route.MaxUploadSize, cfg.MaxUploadSizeFlag),
+			extractMaxSize:  cfg.ExtractMaxSizeFlag,
+			extractMaxFiles: cfg.ExtractMaxFilesFlag,
+			headers:         headers,
+			htpasswd:        htpasswd,
+			rules:           route.Rules,
+			defaultRole:     roleAdmin,
+			header:          splitNames(stringOr(route.Header, cfg.HeaderFlag)),
+			footer:          splitNames(stringOr(route.Footer, cfg.FooterFlag)),
+		}
+		if err := prepareRules(handler.rules); err != nil {
+			return fmt.Errorf("route %q: %v", route.Route, err)
+		}
+		conflict, err := ParseConflict(stringOr(route.Conflict, cfg.ConflictFlag))
+		if err != nil {
+			return fmt.Errorf("route %q: %v", route.Route, err)
+		}
+		handler.conflict = conflict
+		if route.DefaultRole != "" {
+			var err error
+			handler.defaultRole, err = parseRole(route.DefaultRole)
+			if err != nil {
+				return fmt.Errorf("route %q: %v", route.Route, err)
+			}
+		}
+		handler.trashDir, handler.trashRetention = route.Trash, cfg.TrashRetentionFlag
+		if handler.trashDir == "" && cfg.TrashFlag != "" {
+			handler.trashDir = filepath.Join(cfg.TrashFlag, routeFileName(route.Route))
+		}
+		if route.TrashRetention != "" {
+			var err error
+			handler.trashRetention, err = ParseDuration(route.TrashRetention)
+			if err != nil {
+				return fmt.Errorf("route %q: %v", route.Route, err)
+			}
+		}
+		if handler.trashDir != "" {
+			if err := os.MkdirAll(handler.trashDir, 0700); err != nil {
+				return fmt.Errorf("route %q: trash: %v", route.Route, err)
+			}
+			if handler.trashRetention > 0 {
+				go handler.purgeTrashLoop()
+			}
+			log.Printf("trash of %q in %q", route.Route, handler.trashDir)
+		}
+		if boolOr(route.WebDAV, cfg.WebDAVFlag) {
+			handler.webdav = newWebDAVHandler(route.Route, route.Path, handler.noAllowHidden)
+			log.Printf("webdav enabled on %q", route.Route)
+		}
+		if boolOr(route.Index, cfg.IndexFlag) {
+			var err error
+			handler.index, err = newIndex(route.Path)
+			if err != nil {
+				return fmt.Errorf("route %q: index: %v", route.Route, err)
+			}
+		}
+		if boolOr(route.DirSizes, cfg.DirSizesFlag) {
+			handler.dirSizes = newDirSizeCache()
+		}
+		handler.checksumFiles = boolOr(route.ChecksumFiles, cfg.ChecksumFilesFlag)
+		handler.maxFileSize = int64Or(route.MaxFileSize, cfg.MaxFileSizeFlag)
+		quota := Quota{Bytes: int64Or(route.Quota, cfg.QuotaFlag), Files: int64Or(route.QuotaFiles, cfg.QuotaFilesFlag)}
+		userQuotas := route.UserQuotas
+		if userQuotas == nil {
+			userQuotas = cfg.UserQuotasFlag
 		}
+		if quota != (Quota{}) || len(userQuotas) > 0 {
+			ledger := filepath.Join(cfg.StateDirFlag, quotaDirName, routeFileName(route.Route)+".json")
+			handler.quotas = newQuotas(route.Path, ledger, quota, userQuotas, handler.measure)
+		}
+		handlers[route.Route] = handler
 
-		if cfg.UserFlag == "" && cfg.PasswdFlag == "" && route.User == "" && route.Passwd == "" {
-			mux.Handle(route.Route, handlers[route.Route])
+		switch {
+		case route.User != "" && route.Passwd != "":
+			mux.HandleFunc(route.Route, BasicAuth(handler.ServeHTTP, route.User, route.Passwd, customTemplate))
+			log.Printf("auth with serving local path %q on %q", route.Path, route.Route)
+		case htpasswd != nil:
+			mux.HandleFunc(route.Route, HtpasswdAuth(handler.ServeHTTP, htpasswd, route.Users, route.Groups, customTemplate))
+			log.Printf("htpasswd auth with serving local path %q on %q", route.Path, route.Route)
+		case cfg.UserFlag == "" && cfg.PasswdFlag == "":
+			mux.Handle(route.Route, handler)
 			log.Printf("serving local path %q on %q", route.Path, route.Route)
-		} else {
-			_user, _passwd := cfg.UserFlag, cfg.PasswdFlag
-			if route.User != "" && route.Passwd != "" {
-				_user, _passwd = route.User, route.Passwd
-			}
-			mux.HandleFunc(route.Route, BasicAuth(handlers[route.Route].ServeHTTP, _user, _passwd, cfg.CustomTemplateFlag))
+		default:
+			mux.HandleFunc(route.Route, BasicAuth(handler.ServeHTTP, cfg.UserFlag, cfg.PasswdFlag, customTemplate))
 			log.Printf("auth with serving local path %q on %q", route.Path, route.Route)
 		}
 	}
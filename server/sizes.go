@@ -0,0 +1,92 @@
+package server
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// dirSizeTTL is how long a computed folder size is shown before it is
+	// computed again, for changes that did not go through the server
+	dirSizeTTL = 10 * time.Minute
+	// dirSizeWorkers is the number of folders measured at the same time
+	dirSizeWorkers = 4
+)
+
+type dirSize struct {
+	Size     int64
+	Files    int64
+	computed time.Time
+}
+
+// dirSizeCache computes recursive folder sizes in the background and keeps
+// them until they expire or a request changes something below the folder.
+type dirSizeCache struct {
+	mu      sync.Mutex
+	sizes   map[string]dirSize
+	pending map[string]bool
+	workers chan struct{}
+}
+
+func newDirSizeCache() *dirSizeCache {
+	return &dirSizeCache{
+		sizes:   make(map[string]dirSize),
+		pending: make(map[string]bool),
+		workers: make(chan struct{}, dirSizeWorkers),
+	}
+}
+
+// get returns the size of dir if it is known. Missing and expired sizes
+// are computed in the background, expired ones are returned meanwhile.
+func (c *dirSizeCache) get(dir string) (dirSize, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	size, ok := c.sizes[dir]
+	if (!ok || time.Since(size.computed) > dirSizeTTL) && !c.pending[dir] {
+		c.pending[dir] = true
+		go c.compute(dir)
+	}
+	return size, ok
+}
+
+func (c *dirSizeCache) compute(dir string) {
+	c.workers <- struct{}{}
+	size, files, _ := treeSize(dir)
+	<-c.workers
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, dir)
+	c.sizes[dir] = dirSize{Size: size, Files: files, computed: time.Now()}
+}
+
+// invalidate forgets the sizes of p, everything below p and every folder
+// above p up to root.
+func (c *dirSizeCache) invalidate(root, p string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for dir := range c.sizes {
+		if within(p, dir) {
+			delete(c.sizes, dir)
+		}
+	}
+	for dir := p; within(root, dir); dir = filepath.Dir(dir) {
+		delete(c.sizes, dir)
+		if dir == root {
+			break
+		}
+	}
+}
+
+// dirSize returns the recursive size of the folder absPath, from the index
+// if the route has one.
+func (f *FileHandler) dirSize(absPath string) (dirSize, bool) {
+	if f.index != nil {
+		size, files, ok := f.index.treeSize(absPath)
+		if ok {
+			return dirSize{Size: size, Files: files}, true
+		}
+	}
+	return f.dirSizes.get(absPath)
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	sortKey   = "sort"
+	orderKey  = "order"
+	filterKey = "filter"
+	sortName  = "name"
+	sortSize  = "size"
+	sortMod   = "modified"
+	sortType  = "type"
+	orderAsc  = "asc"
+	orderDesc = "desc"
+)
+
+// listingOrder returns the sort column and direction of a listing request,
+// name and ascending if they are missing or unknown.
+func listingOrder(r *http.Request) (by, order string) {
+	q := r.URL.Query()
+	by, order = q.Get(sortKey), q.Get(orderKey)
+	switch by {
+	case sortName, sortSize, sortMod, sortType:
+	default:
+		by = sortName
+	}
+	if order != orderDesc {
+		order = orderAsc
+	}
+	return by, order
+}
+
+// sortFiles sorts files by the given column, folders always first. Ties are
+// broken by name so the order is stable across pages.
+func sortFiles(files []os.FileInfo, by, order string) {
+	compare := func(a, b os.FileInfo) int {
+		switch {
+		case by == sortSize && !a.IsDir() && a.Size() != b.Size():
+			return compareInt64(a.Size(), b.Size())
+		case by == sortMod && !a.ModTime().Equal(b.ModTime()):
+			if a.ModTime().Before(b.ModTime()) {
+				return -1
+			}
+			return 1
+		case by == sortType && !a.IsDir():
+			if ta, tb := strings.ToLower(filepath.Ext(a.Name())), strings.ToLower(filepath.Ext(b.Name())); ta != tb {
+				return strings.Compare(ta, tb)
+			}
+		}
+		if na, nb := strings.ToLower(a.Name()), strings.ToLower(b.Name()); na != nb {
+			return strings.Compare(na, nb)
+		}
+		return strings.Compare(a.Name(), b.Name())
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].IsDir() != files[j].IsDir() {
+			return files[i].IsDir()
+		}
+		c := compare(files[i], files[j])
+		if order == orderDesc {
+			return c > 0
+		}
+		return c < 0
+	})
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// filterFiles keeps the files whose name matches the ?filter of r.
+func filterFiles(r *http.Request, files []os.FileInfo) ([]os.FileInfo, error) {
+	glob, err := namePattern(r.URL.Query().Get(filterKey))
+	if err != nil || glob == "" {
+		return files, err
+	}
+	matching := files[:0]
+	for _, info := range files {
+		if matchName(glob, info.Name()) {
+			matching = append(matching, info)
+		}
+	}
+	return matching, nil
+}
+
+// sortURLs returns the listing URL for sorting by each column. The column
+// the listing is sorted by links to the other direction.
+func sortURLs(r *http.Request) map[string]*url.URL {
+	by, order := listingOrder(r)
+	urls := make(map[string]*url.URL)
+	for _, column := range []string{sortName, sortSize, sortMod, sortType} {
+		u := *r.URL
+		q := u.Query()
+		q.Del(pageKey)
+		q.Set(sortKey, column)
+		q.Set(orderKey, orderAsc)
+		if column == by && order == orderAsc {
+			q.Set(orderKey, orderDesc)
+		}
+		u.RawQuery = q.Encode()
+		urls[column] = &u
+	}
+	return urls
+}
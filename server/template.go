@@ -7,15 +7,40 @@ const directoryListingTemplateText = `
 <head>
 	<title>{{ .Title }}</title>
 	<meta name="viewport" content="width=device-width, initial-scale=1">
-	<style>body{font-family: sans-serif;width: 90%;padding-left: 5%;padding-top: 10px;}td{padding:.5em;}a{display:block;}tbody tr:nth-child(odd){background:#eee;}.number{text-align:right}.text{text-align:left;word-break:break-all;}canvas,table{width:100%;max-width:100%;}</style>
+	<style>body{font-family: sans-serif;width: 90%;padding-left: 5%;padding-top: 10px;}td{padding:.5em;}a{display:block;}tbody tr:nth-child(odd){background:#eee;}.number{text-align:right}.text{text-align:left;word-break:break-all;}canvas,table{width:100%;max-width:100%;}.pages a,a.preview{display:inline;margin:0 .5em;}a.preview{font-size:small;}.gallery{display:flex;flex-wrap:wrap;}.gallery figure{width:170px;margin:.5em;text-align:center;word-break:break-all;}.gallery img{max-width:160px;max-height:160px;}.gallery .icon{font-size:80px;}#lightbox{display:none;position:fixed;top:0;left:0;width:100%;height:100%;background:rgba(0,0,0,.85);align-items:center;justify-content:center;flex-direction:column;color:#fff;}#lightbox img{max-width:95%;max-height:90%;}.readme{max-width:60em;line-height:1.5;}.readme pre,.readme code{background:#f4f4f4;}</style>
 </head>
 <body>
 <h1>{{ .Title }}</h1>
-{{ if or .Files .AllowUpload }}
+{{- with .Quota }}
+<p>{{ if .User }}Your quota{{ else }}Quota{{ end }}: {{ .Used }}{{ if .Limit }} of {{ .Limit }} used, {{ .Left }} left{{ else }} used{{ end }}{{ if .MaxFiles }}, {{ .Files }} of {{ .MaxFiles }} files{{ end }}</p>
+{{- end }}
+{{ if or .Files .AllowUpload .Filter }}
 <div>
-<a href="{{ .TarGzURL }}">.tar.gz of all files</a>
-<a href="{{ .ZipURL }}">.zip of all files</a>
+{{- range .Archives }}
+<a href="{{ .URL }}">.{{ .Format }} of all files</a>
+{{- end }}
+{{- if .TrashURL }}
+<a href="{{ .TrashURL }}">trash</a>
+{{- end }}
+{{- if .ChecksumsURL }}
+<a href="{{ .ChecksumsURL }}">SHA256SUMS</a>
+{{- end }}
+<a href="{{ .ViewURL }}">{{ if .Gallery }}list view{{ else }}gallery view{{ end }}</a>
 </div>
+<form method="get">
+	<input type="hidden" name="search">
+	<input type="text" name="name" placeholder="Search files">
+	<input type="submit" value="Search">
+</form>
+<form method="get">
+	<input type="hidden" name="sort" value="{{ .Sort }}">
+	<input type="hidden" name="order" value="{{ .Order }}">
+	{{- if .Gallery }}
+	<input type="hidden" name="view" value="gallery">
+	{{- end }}
+	<input type="text" name="filter" placeholder="Filter, e.g. *.log" value="{{ .Filter }}">
+	<input type="submit" value="Filter">
+</form>
 <br>
 <div>
 {{ if .AllowCreate }}
@@ -24,36 +49,186 @@ const directoryListingTemplateText = `
 {{- end }}
 </div>
 <hr>
+<div id="status"></div>
+{{- if .Header }}
+<div class=readme>{{ .Header }}</div>
+{{- end }}
+{{- if .Gallery }}
+<div class=gallery>
+	<figure><a class=icon href="../">&#11025;</a><figcaption>..</figcaption></figure>
+	{{- range .Files }}
+	<figure>
+		{{- if .ThumbURL }}
+		<a href="{{ .URL.String }}" onclick="return lightbox(this)"><img src="{{ .ThumbURL }}" alt="{{ .Name }}" loading="lazy"></a>
+		{{- else }}
+		<a class=icon href="{{ .URL.String }}">{{ if .IsDir }}&#128193;{{ else }}&#128196;{{ end }}</a>
+		{{- end }}
+		<figcaption>{{ .Name }}</figcaption>
+	</figure>
+	{{- end }}
+</div>
+<div id="lightbox" onclick="closeLightbox()"><img alt=""><p></p></div>
+{{- else }}
 <table>
 	<thead>
-		<th>Name</th>
-		<th>Modified</th>
-		<th>Type</th>
-		<th class=number>Size (bytes)</th>
+		<th><a href="{{ index .SortURLs "name" }}">Name{{ if eq .Sort "name" }}{{ if eq .Order "desc" }} &#9660;{{ else }} &#9650;{{ end }}{{ end }}</a></th>
+		<th><a href="{{ index .SortURLs "modified" }}">Modified{{ if eq .Sort "modified" }}{{ if eq .Order "desc" }} &#9660;{{ else }} &#9650;{{ end }}{{ end }}</a></th>
+		<th><a href="{{ index .SortURLs "type" }}">Type{{ if eq .Sort "type" }}{{ if eq .Order "desc" }} &#9660;{{ else }} &#9650;{{ end }}{{ end }}</a></th>
+		<th class=number><a href="{{ index .SortURLs "size" }}">Size (bytes){{ if eq .Sort "size" }}{{ if eq .Order "desc" }} &#9660;{{ else }} &#9650;{{ end }}{{ end }}</a></th>
+		{{- if or .AllowRename .AllowUpload .AllowDelete }}
+		<th>Actions</th>
+		{{- end }}
 	</thead>
 	<tbody>
-	<tr><td colspan=4><a href="../">..</a></td></tr>
+	<tr><td colspan=5><a href="../">..</a></td></tr>
 	{{- range .Files }}
 	<tr>
-		<td class=text><a href="{{ .URL.String }}">{{ .Name }}</td>
+		<td class=text><a href="{{ .URL.String }}">{{ .Name }}</a>{{ if .PreviewURL }}<a class=preview href="{{ .PreviewURL }}">preview</a>{{ end }}</td>
 		<td>{{ .Modified }}</td>
 		{{ if (not .IsDir) }}
 		<td>{{ .Type }}</td>
 		<td class=number>{{ .Size.String }} ({{ .Size | printf "%d" }})</td>
 		{{ else }}
 		<td>{{ .Type }} [files in: {{ .FCount }}]</td>
-		<td class=number>---</td>
+		<td class=number>{{ if .HasTreeSize }}{{ .TreeSize.String }} ({{ .TreeSize | printf "%d" }}, {{ .TreeFiles }} files){{ else }}---{{ end }}</td>
 		{{ end }}
+		{{- if or $.AllowRename $.AllowUpload $.AllowDelete }}
+		<td>
+		{{- if $.AllowRename }}
+			<button type="button" onclick="rename({{ .URL.String }}, {{ .Name }})">Rename</button>
+		{{- end }}
+		{{- if $.AllowUpload }}
+			<button type="button" onclick="copy({{ .URL.String }}, {{ .Name }})">Copy</button>
+		{{- end }}
+		{{- if $.AllowDelete }}
+			<button type="button" onclick="remove({{ .URL.String }}, {{ .Name }})">Delete</button>
+		{{- end }}
+		</td>
+		{{- end }}
 	</tr>
 	{{- end }}
 	{{- if .AllowUpload }}
-	<tr><td colspan=4><form method="post" enctype="multipart/form-data"><input required name="file" type="file multiple"/><input value="Upload" type="submit"/></form></td></tr>
+	<tr><td colspan=5><form method="post" enctype="multipart/form-data"><input required name="file" type="file" multiple/><input value="Upload" type="submit"/></form></td></tr>
+	{{- if .AllowCreate }}
+	<tr><td colspan=5><form method="post" enctype="multipart/form-data"><input required name="file" type="file" webkitdirectory multiple/><input value="Upload folder" type="submit"/></form></td></tr>
+	{{- end }}
+	<tr><td colspan=5><form method="post" action="?extract" enctype="multipart/form-data"><input required name="file" type="file" accept=".zip,.tar,.tar.gz,.tgz,.tar.zst,.tzst"/><input value="Upload and extract" type="submit"/></form></td></tr>
 	{{- end }}
 	</tbody>
 </table>
+{{- end }}
+{{- if gt .Pages 1 }}
+<p class=pages>
+{{- if .PrevURL }}
+	<a href="{{ .FirstURL }}">&laquo; first</a>
+	<a href="{{ .PrevURL }}">&lsaquo; previous</a>
+{{- end }}
+	page {{ .Page }} of {{ .Pages }} ({{ .Total }} entries)
+{{- if .NextURL }}
+	<a href="{{ .NextURL }}">next &rsaquo;</a>
+	<a href="{{ .LastURL }}">last &raquo;</a>
+{{- end }}
+</p>
+{{- end }}
+{{- if .Footer }}
+<hr>
+<div class=readme>{{ .Footer }}</div>
+{{- end }}
 {{ end }}
 <script type="text/javascript">
 
+    let images = [], shown = -1
+
+    function lightbox(link) {
+        images = Array.from(document.querySelectorAll(".gallery a[onclick]"))
+        show(images.indexOf(link))
+        return false
+    }
+
+    function show(i) {
+        const box = document.getElementById("lightbox")
+        shown = (i + images.length) % images.length
+        box.querySelector("img").src = images[shown].href
+        box.querySelector("p").textContent = images[shown].querySelector("img").alt
+        box.style.display = "flex"
+    }
+
+    function closeLightbox() {
+        document.getElementById("lightbox").style.display = "none"
+        shown = -1
+    }
+
+    document.addEventListener("keydown", (e) => {
+        if (shown < 0)
+            return
+        if (e.key === "ArrowRight")
+            show(shown + 1)
+        else if (e.key === "ArrowLeft")
+            show(shown - 1)
+        else if (e.key === "Escape")
+            closeLightbox()
+    })
+
+ function rename(url, name) {
+        const to = prompt("New name, or a path starting with / to move it", name)
+        if (!to || to === name)
+            return
+
+        send(url + "?rename", {
+            method: 'POST',
+            headers: {"Content-Type": "application/x-www-form-urlencoded"},
+            body: "to=" + encodeURIComponent(to)
+        })
+    }
+
+ function copy(url, name) {
+        const to = prompt("Copy to (name, or a path starting with /)", "copy of " + name)
+        if (!to)
+            return
+
+        fetch(url + "?copy", {
+            method: 'POST',
+            headers: {"Content-Type": "application/x-www-form-urlencoded"},
+            body: "to=" + encodeURIComponent(to)
+        }).then((response) => {
+            if (response.status === 202) {
+                progress(response.headers.get("Location"))
+            } else if (!response.ok) {
+                alert("HTTP error: "+ response.statusText + "! Status: " + response.status);
+            } else {
+                window.location.reload();
+            }
+        }).catch(err => {
+            alert(err)
+        });
+    }
+
+    function progress(jobUrl) {
+        fetch(jobUrl).then((response) => response.json()).then((job) => {
+            const status = document.getElementById("status")
+            status.textContent = "Copying " + job.source + ": " + job.copied_files + "/" + job.total_files +
+                " files, " + job.copied_bytes + "/" + job.total_bytes + " bytes"
+            if (!job.done) {
+                setTimeout(() => progress(jobUrl), 1000)
+            } else if (job.error) {
+                status.textContent = "Copy failed: " + job.error
+            } else {
+                window.location.reload();
+            }
+        }).catch(err => {
+            alert(err)
+        });
+    }
+
+ function remove(url, name) {
+        if (!confirm("Delete " + name + "?"))
+            return
+
+        send(url, {
+            method: 'DELETE'
+        })
+    }
+
  function create() {
         const name = document.getElementById("newfolder").value
         if (name.length === 0)
@@ -84,6 +259,196 @@ const directoryListingTemplateText = `
 </html>
 `
 
+const trashTemplateText = `
+<html>
+<head>
+	<title>{{ .Title }}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<style>body{font-family: sans-serif;width: 90%;padding-left: 5%;padding-top: 10px;}td{padding:.5em;}tbody tr:nth-child(odd){background:#eee;}.number{text-align:right}.text{text-align:left;word-break:break-all;}table{width:100%;max-width:100%;}</style>
+</head>
+<body>
+<h1>{{ .Title }}</h1>
+<a href="{{ .ListingURL }}">back to the listing</a>
+{{- if .Retention }}
+<p>Items are deleted permanently {{ .Retention }} after they were moved to the trash.</p>
+{{- end }}
+<hr>
+<table>
+	<thead>
+		<th>Original path</th>
+		<th>Deleted</th>
+		<th>By</th>
+		<th class=number>Size (bytes)</th>
+		<th>Actions</th>
+	</thead>
+	<tbody>
+	{{- range .Items }}
+	<tr>
+		<td class=text>{{ .Path }}{{ if .IsDir }}/{{ end }}</td>
+		<td>{{ .Deleted.Format "2006-01-02 15:04:05" }}</td>
+		<td>{{ .User }}</td>
+		<td class=number>{{ .Size }}</td>
+		<td>
+			<form method="post" action="?trash&restore={{ .ID }}" style="display:inline"><input type="submit" value="Restore"></form>
+			<form method="post" action="?trash&purge={{ .ID }}" style="display:inline" onsubmit="return confirm('Delete permanently?')"><input type="submit" value="Delete permanently"></form>
+		</td>
+	</tr>
+	{{- else }}
+	<tr><td colspan=5>The trash is empty.</td></tr>
+	{{- end }}
+	</tbody>
+</table>
+</body>
+</html>
+`
+
+const searchTemplateText = `
+<html>
+<head>
+	<title>Search in {{ .Title }}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<style>body{font-family: sans-serif;width: 90%;padding-left: 5%;padding-top: 10px;}td{padding:.5em;}a{display:block;}tbody tr:nth-child(odd){background:#eee;}.number{text-align:right}.text{text-align:left;word-break:break-all;}table{width:100%;max-width:100%;}form input,form select{margin:.2em;}</style>
+</head>
+<body>
+<h1>Search in {{ .Title }}</h1>
+<a href="{{ .ListingURL }}">back to the listing</a>
+<form method="get">
+	<input type="hidden" name="search">
+	<input type="text" name="name" placeholder="Name or *.glob" value="{{ .Query.Name }}">
+	<input type="text" name="regex" placeholder="Path regex" value="{{ .Query.Regex }}">
+	<input type="text" name="text" placeholder="Containing text" value="{{ .Query.Text }}">
+	<input type="text" name="min-size" placeholder="Min size (10k)" value="{{ .Query.MinSize }}" size="10">
+	<input type="text" name="max-size" placeholder="Max size (1g)" value="{{ .Query.MaxSize }}" size="10">
+	<input type="date" name="after" value="{{ .Query.After }}" title="Modified after">
+	<input type="date" name="before" value="{{ .Query.Before }}" title="Modified before">
+	<select name="type">
+		<option value="">Files and folders</option>
+		<option value="file"{{ if eq .Query.Type "file" }} selected{{ end }}>Files</option>
+		<option value="dir"{{ if eq .Query.Type "dir" }} selected{{ end }}>Folders</option>
+	</select>
+	<input type="submit" value="Search">
+</form>
+<hr>
+{{- if .Truncated }}
+<p>Only the first {{ len .Files }} results are shown.</p>
+{{- end }}
+<table>
+	<thead>
+		<th>Name</th>
+		<th>Modified</th>
+		<th>Type</th>
+		<th class=number>Size (bytes)</th>
+	</thead>
+	<tbody>
+	{{- range .Files }}
+	<tr>
+		<td class=text><a href="{{ .URL.String }}">{{ .Name }}{{ if .IsDir }}/{{ end }}</a></td>
+		<td>{{ .Modified }}</td>
+		<td>{{ .Type }}</td>
+		<td class=number>{{ if not .IsDir }}{{ .Size | printf "%d" }}{{ else if .HasTreeSize }}{{ .TreeSize | printf "%d" }}{{ else }}---{{ end }}</td>
+	</tr>
+	{{- else }}
+	<tr><td colspan=4>No matches.</td></tr>
+	{{- end }}
+	</tbody>
+</table>
+</body>
+</html>
+`
+
+const previewTemplateText = `
+<html>
+<head>
+	<title>{{ .Title }}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<style>body{font-family: sans-serif;width: 90%;padding-left: 5%;padding-top: 10px;}td,th{padding:.3em .5em;text-align:left;}tbody tr:nth-child(odd){background:#eee;}table{border-collapse:collapse;}img,video,iframe{max-width:100%;}iframe{width:100%;height:85vh;border:0;}pre{white-space:pre-wrap;}.markdown{max-width:60em;line-height:1.5;}.markdown pre,.markdown code{background:#f4f4f4;}{{ .CSS }}</style>
+</head>
+<body>
+<h1>{{ .Name }}</h1>
+<p><a href="{{ .ListingURL }}">back to the listing</a> | <a href="{{ .RawURL }}" download>download</a> ({{ .Size.String }})</p>
+<hr>
+{{- if eq .Kind "markdown" }}
+<div class=markdown>{{ .HTML }}</div>
+{{- else if or (eq .Kind "code") (eq .Kind "text") }}
+{{ .HTML }}
+{{- else if eq .Kind "table" }}
+<table>
+	{{- range $i, $row := .Rows }}
+	<tr>{{ range $row }}{{ if eq $i 0 }}<th>{{ . }}</th>{{ else }}<td>{{ . }}</td>{{ end }}{{ end }}</tr>
+	{{- end }}
+</table>
+{{- if .Truncated }}
+<p>Only the first rows are shown.</p>
+{{- end }}
+{{- else if eq .Kind "image" }}
+<img src="{{ .RawURL }}" alt="{{ .Name }}">
+{{- else if eq .Kind "pdf" }}
+<iframe src="{{ .RawURL }}" title="{{ .Name }}"></iframe>
+{{- else if eq .Kind "video" }}
+<video src="{{ .RawURL }}" controls></video>
+{{- else if eq .Kind "audio" }}
+<audio src="{{ .RawURL }}" controls></audio>
+{{- else }}
+<p>There is no preview for this file.</p>
+{{- end }}
+</body>
+</html>
+`
+
+const extractTemplateText = `
+<html>
+<head>
+	<title>Extracted into {{ .Title }}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<style>body{font-family: sans-serif;width: 90%;padding-left: 5%;padding-top: 10px;}td{padding:.5em;}tbody tr:nth-child(odd){background:#eee;}.number{text-align:right}.text{text-align:left;word-break:break-all;}table{width:100%;max-width:100%;}</style>
+</head>
+<body>
+<h1>Extracted into {{ .Title }}</h1>
+<a href="{{ .ListingURL }}">back to the listing</a>
+<p>{{ .Files }} files ({{ .Size }} bytes) from {{ range $i, $a := .Archives }}{{ if $i }}, {{ end }}{{ $a }}{{ end }}.</p>
+<hr>
+<table>
+	<thead>
+		<th>Path</th>
+		<th class=number>Size (bytes)</th>
+		<th>Status</th>
+	</thead>
+	<tbody>
+	{{- range .Entries }}
+	<tr>
+		<td class=text>{{ .Path }}{{ if .IsDir }}/{{ end }}</td>
+		<td class=number>{{ if not (or .IsDir .Skipped) }}{{ .Size }}{{ end }}</td>
+		<td>{{ if .Skipped }}skipped: {{ .Skipped }}{{ else }}extracted{{ end }}</td>
+	</tr>
+	{{- else }}
+	<tr><td colspan=3>The archives were empty.</td></tr>
+	{{- end }}
+	</tbody>
+</table>
+</body>
+</html>
+`
+
+const tooLargeTemplateText = `
+<html>
+<head>
+	<title>Too large</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<style>body{font-family: sans-serif;width: 90%;padding-left: 5%;padding-top: 10px;}</style>
+</head>
+<body>
+<h1>Too large</h1>
+<p>{{ .Message }}</p>
+<a href="{{ .ListingURL }}">back to the listing</a>
+</body>
+</html>
+`
+
 var (
 	directoryListingTemplate = template.Must(template.New("").Parse(directoryListingTemplateText))
+	trashTemplate            = template.Must(template.New("").Parse(trashTemplateText))
+	searchTemplate           = template.Must(template.New("").Parse(searchTemplateText))
+	previewTemplate          = template.Must(template.New("").Parse(previewTemplateText))
+	extractTemplate          = template.Must(template.New("").Parse(extractTemplateText))
+	tooLargeTemplate         = template.Must(template.New("").Parse(tooLargeTemplateText))
 )
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	thumbKey      = "thumb"
+	viewKey       = "view"
+	viewGallery   = "gallery"
+	thumbCacheDir = "thumbs"
+	thumbSize     = 256
+	thumbQuality  = 85
+	// thumbMaxPixels protects against images that decode to huge bitmaps
+	thumbMaxPixels = 100 << 20
+	// thumbRetention is how long thumbnails are kept after they were last
+	// served, which also removes those of changed or deleted images
+	thumbRetention = 30 * 24 * time.Hour
+	// thumbCleanupInterval is how often the cache is checked for them
+	thumbCleanupInterval = time.Hour
+)
+
+var (
+	// thumbSizes are the sizes thumbnails are made in, so that each image
+	// has only a few in the cache
+	thumbSizes = []int{128, thumbSize, 512, 1024}
+	// thumbCleanupLast is when the cache was last cleaned up, in Unix
+	// nanoseconds
+	thumbCleanupLast int64
+
+	// thumbWorkers limits the number of images decoded at the same time
+	thumbWorkers = make(chan struct{}, runtime.NumCPU())
+
+	errNoImage = errors.New("not a supported image")
+)
+
+// isImage reports whether name has the extension of an image thumbnails
+// can be made of.
+func isImage(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp":
+		return true
+	}
+	return false
+}
+
+// viewURL returns the listing URL that switches between the table and
+// the gallery view.
+func viewURL(r *http.Request, gallery bool) *url.URL {
+	u := *r.URL
+	q := u.Query()
+	q.Del(viewKey)
+	if !gallery {
+		q.Set(viewKey, viewGallery)
+	}
+	u.RawQuery = q.Encode()
+	return &u
+}
+
+// thumbPath returns the cache file of a thumbnail of osPath. Modified or
+// replaced images get a new key.
+func (f *FileHandler) thumbPath(osPath string, info os.FileInfo, size int) string {
+	key := fmt.Sprintf("%s\x00%d\x00%d\x00%d", osPath, info.ModTime().UnixNano(), info.Size(), size)
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(f.stateDir, thumbCacheDir, hex.EncodeToString(sum[:])+".jpg")
+}
+
+// roundThumbSize rounds a requested size up to the next of thumbSizes.
+func roundThumbSize(n int) int {
+	for _, size := range thumbSizes {
+		if n <= size {
+			return size
+		}
+	}
+	return thumbSizes[len(thumbSizes)-1]
+}
+
+// thumbCleanup removes thumbnails that were not served for thumbRetention.
+// It does nothing if it ran less than thumbCleanupInterval ago.
+func (f *FileHandler) thumbCleanup() {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&thumbCleanupLast)
+	if now-last < int64(thumbCleanupInterval) || !atomic.CompareAndSwapInt64(&thumbCleanupLast, last, now) {
+		return
+	}
+	dir := filepath.Join(f.stateDir, thumbCacheDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < thumbRetention {
+			continue
+		}
+		_ = os.Remove(filepath.Join(dir, entry.Name()))
+	}
+}
+
+// makeThumb scales the image at src to fit into size x size and writes it
+// as JPEG to dst.
+func makeThumb(src, dst string, size int) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	config, _, err := image.DecodeConfig(in)
+	if err != nil {
+		return errNoImage
+	}
+	if config.Width*config.Height > thumbMaxPixels {
+		return fmt.Errorf("%w: %dx%d is too large", errNoImage, config.Width, config.Height)
+	}
+	if _, err := in.Seek(0, 0); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(in)
+	if err != nil {
+		return errNoImage
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, h*size/w
+		} else {
+			w, h = w*size/h, size
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	thumb := image.NewRGBA(image.Rect(0, 0, w, h))
+	// transparent images get a white background, JPEG has no alpha
+	draw.Draw(thumb, thumb.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, b, draw.Over, nil)
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".thumb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := jpeg.Encode(tmp, thumb, &jpeg.Options{Quality: thumbQuality}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// serveThumb answers GET ?thumb with a JPEG thumbnail of an image, at most
+// 256 pixels (or ?thumb=N, rounded up to one of thumbSizes) wide and high.
+func (f *FileHandler) serveThumb(w http.ResponseWriter, r *http.Request, osPath string, info os.FileInfo) error {
+	size := thumbSize
+	if n, err := strconv.Atoi(r.URL.Query().Get(thumbKey)); err == nil && n > 0 {
+		size = roundThumbSize(n)
+	}
+	if info.IsDir() || !isImage(info.Name()) {
+		return f.serveStatus(w, r, http.StatusUnsupportedMediaType)
+	}
+	thumb := f.thumbPath(osPath, info, size)
+	if cached, err := os.Stat(thumb); err != nil {
+		thumbWorkers <- struct{}{}
+		err := makeThumb(osPath, thumb, size)
+		<-thumbWorkers
+		if errors.Is(err, errNoImage) {
+			_ = f.serveStatus(w, r, http.StatusUnsupportedMediaType)
+			return err
+		} else if err != nil {
+			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+			return err
+		}
+		go f.thumbCleanup()
+	} else if now := time.Now(); now.Sub(cached.ModTime()) > 24*time.Hour {
+		// the modification time tells thumbCleanup when it was last served
+		_ = os.Chtimes(thumb, now, now)
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeFile(w, r, thumb)
+	return nil
+}
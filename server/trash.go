@@ -0,0 +1,287 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	trashKey   = "trash"
+	restoreKey = "restore"
+	purgeKey   = "purge"
+
+	trashPurgeInterval = time.Hour
+)
+
+// trashItem is stored as <id>.json next to the <id> folder that holds the
+// deleted file or folder.
+type trashItem struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	Deleted time.Time `json:"deleted"`
+	User    string    `json:"user,omitempty"`
+}
+
+type trashListingData struct {
+	Title      string
+	Items      []trashItem
+	ListingURL string
+	Retention  time.Duration
+}
+
+// ParseDuration is time.ParseDuration that also accepts days ("30d").
+func ParseDuration(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// routeFileName turns a route into a file or folder name for its trash in
+// the global trash and its quota ledger. Slashes are escaped, so no two
+// routes share a name.
+func routeFileName(route string) string {
+	name := strings.Trim(route, "/")
+	if name == "" {
+		// no other route escapes to a lone slash
+		return url.PathEscape("/")
+	}
+	return url.PathEscape(name)
+}
+
+// moveTree renames src to dst and falls back to copy and delete when they
+// are on different file systems.
+func moveTree(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyTree(src, dst, &copyJob{}); err != nil {
+		_ = os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// remove deletes osPath, or moves it to the trash if the route has one.
+func (f *FileHandler) remove(r *http.Request, osPath string, info os.FileInfo) error {
+	if f.trashDir == "" {
+		if info.IsDir() {
+			return os.RemoveAll(osPath)
+		}
+		return os.Remove(osPath)
+	}
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(f.path, osPath)
+	if err != nil {
+		return err
+	}
+	item := trashItem{
+		ID:      id,
+		Name:    info.Name(),
+		Path:    "/" + filepath.ToSlash(rel),
+		IsDir:   info.IsDir(),
+		Size:    info.Size(),
+		Deleted: time.Now(),
+		User:    requestUser(r),
+	}
+	if info.IsDir() {
+		item.Size, _, _ = treeSize(osPath)
+	}
+	itemDir := filepath.Join(f.trashDir, id)
+	if err := os.MkdirAll(itemDir, 0700); err != nil {
+		return err
+	}
+	if err := moveTree(osPath, filepath.Join(itemDir, info.Name())); err != nil {
+		_ = os.RemoveAll(itemDir)
+		return err
+	}
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	log.Printf("moved %q to trash %s", osPath, id)
+	return os.WriteFile(itemDir+".json", b, 0600)
+}
+
+func (f *FileHandler) trashItems() ([]trashItem, error) {
+	entries, err := os.ReadDir(f.trashDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var items []trashItem
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(f.trashDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var item trashItem
+		if json.Unmarshal(b, &item) == nil {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Deleted.After(items[j].Deleted) })
+	return items, nil
+}
+
+func (f *FileHandler) trashItem(id string) (trashItem, error) {
+	var item trashItem
+	if strings.ContainsAny(id, `/\.`) || id == "" {
+		return item, os.ErrNotExist
+	}
+	b, err := os.ReadFile(filepath.Join(f.trashDir, id+".json"))
+	if err != nil {
+		return item, err
+	}
+	return item, json.Unmarshal(b, &item)
+}
+
+func (f *FileHandler) purgeTrashItem(id string) error {
+	if err := os.RemoveAll(filepath.Join(f.trashDir, id)); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(f.trashDir, id+".json"))
+}
+
+func (f *FileHandler) restoreTrashItem(item trashItem) error {
+	dst := filepath.Join(f.path, filepath.FromSlash(path.Clean(item.Path)))
+	if !withinNoLinks(f.path, dst) {
+		return errOutsideRoute
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return errExists
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := moveTree(filepath.Join(f.trashDir, item.ID, item.Name), dst); err != nil {
+		return err
+	}
+	log.Printf("restored %q from trash %s", dst, item.ID)
+	return f.purgeTrashItem(item.ID)
+}
+
+// purgeTrash removes items older than the retention period.
+func (f *FileHandler) purgeTrash() {
+	items, err := f.trashItems()
+	if err != nil {
+		log.Println("trash:", err)
+		return
+	}
+	for _, item := range items {
+		if time.Since(item.Deleted) < f.trashRetention {
+			continue
+		}
+		if err := f.purgeTrashItem(item.ID); err != nil {
+			log.Println("trash:", err)
+		} else {
+			log.Printf("purged %q from trash", item.Path)
+		}
+	}
+}
+
+func (f *FileHandler) purgeTrashLoop() {
+	for {
+		f.purgeTrash()
+		time.Sleep(trashPurgeInterval)
+	}
+}
+
+// serveTrash lists the trash (GET ?trash) and restores (POST ?trash&restore=ID)
+// or permanently deletes (POST ?trash&purge=ID) items. Users only see the
+// items they could delete at their original place.
+func (f *FileHandler) serveTrash(w http.ResponseWriter, r *http.Request) error {
+	if f.trashDir == "" {
+		return f.serveStatus(w, r, http.StatusNotFound)
+	}
+	query := r.URL.Query()
+	if r.Method == http.MethodPost && (query.Has(restoreKey) || query.Has(purgeKey)) {
+		id := query.Get(restoreKey)
+		if id == "" {
+			id = query.Get(purgeKey)
+		}
+		item, err := f.trashItem(id)
+		if err != nil {
+			return f.serveStatus(w, r, http.StatusNotFound)
+		}
+		if !f.permissions(r, filepath.Join(f.path, filepath.FromSlash(item.Path))).delete {
+			return f.serveStatus(w, r, http.StatusForbidden)
+		}
+		if query.Has(restoreKey) {
+			err = f.restoreTrashItem(item)
+		} else {
+			err = f.purgeTrashItem(item.ID)
+		}
+		switch {
+		case errors.Is(err, errExists):
+			return f.serveStatus(w, r, http.StatusConflict)
+		case err != nil:
+			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+			return err
+		}
+		w.Header().Set("Location", f.route+"?"+trashKey)
+		w.WriteHeader(http.StatusSeeOther)
+		return nil
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return f.serveStatus(w, r, http.StatusMethodNotAllowed)
+	}
+
+	all, err := f.trashItems()
+	if err != nil {
+		_ = f.serveStatus(w, r, http.StatusInternalServerError)
+		return err
+	}
+	items := make([]trashItem, 0, len(all))
+	for _, item := range all {
+		if f.permissions(r, filepath.Join(f.path, filepath.FromSlash(item.Path))).delete {
+			items = append(items, item)
+		}
+	}
+	if wantsJSON(r) {
+		return writeJSON(w, http.StatusOK, struct {
+			Version int         `json:"version"`
+			Items   []trashItem `json:"items"`
+		}{listingSchemaVersion, items})
+	}
+
+	tmpl := trashTemplate
+	if f.customTemplate != "" {
+		if custom, e := template.ParseFiles(f.customTemplate + osPathSeparator + "trash.html"); e == nil {
+			tmpl = custom
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return tmpl.Execute(w, trashListingData{
+		Title:      "Trash of " + filepath.Base(f.path),
+		Items:      items,
+		ListingURL: (&url.URL{Path: f.route}).String(),
+		Retention:  f.trashRetention,
+	})
+}
@@ -0,0 +1,363 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tus.io resumable upload protocol, see https://tus.io/protocols/resumable-upload
+const (
+	tusKey              = "tus"
+	tusVersion          = "1.0.0"
+	tusExtensions       = "creation,termination"
+	tusOffsetType       = "application/offset+octet-stream"
+	tusResumableHeader  = "Tus-Resumable"
+	tusUploadLength     = "Upload-Length"
+	tusUploadOffset     = "Upload-Offset"
+	tusUploadMetadata   = "Upload-Metadata"
+	tusStagingDir       = "tus"
+	tusUploadExpiration = 24 * time.Hour
+)
+
+// tusUpload is stored as <id>.json next to the partial data in the staging area.
+type tusUpload struct {
+	Route    string    `json:"route"`
+	Dir      string    `json:"dir"`
+	Filename string    `json:"filename"`
+	Length   int64     `json:"length"`
+	Created  time.Time `json:"created"`
+}
+
+// tusLocks prevents concurrent PATCH requests on the same upload.
+var tusLocks sync.Map
+
+func (f *FileHandler) tusStaging() string {
+	return filepath.Join(f.stateDir, tusStagingDir)
+}
+
+func (f *FileHandler) tusPaths(id string) (data, info string) {
+	data = filepath.Join(f.tusStaging(), id)
+	return data, data + ".json"
+}
+
+func isTusRequest(r *http.Request) bool {
+	return r.Header.Get(tusResumableHeader) != "" || r.URL.Query().Has(tusKey)
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2".
+func parseTusMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if kv[0] == "" {
+			continue
+		}
+		value := ""
+		if len(kv) == 2 {
+			if b, err := base64.StdEncoding.DecodeString(kv[1]); err == nil {
+				value = string(b)
+			}
+		}
+		meta[kv[0]] = value
+	}
+	return meta
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (f *FileHandler) serveTus(w http.ResponseWriter, r *http.Request, osPath string, perms permissions) {
+	w.Header().Set(tusResumableHeader, tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		if f.maxUploadSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(f.maxUploadSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get(tusResumableHeader) != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		_ = f.serveStatus(w, r, http.StatusPreconditionFailed)
+		return
+	}
+	if !perms.upload {
+		_ = f.serveStatus(w, r, http.StatusForbidden)
+		return
+	}
+	info, err := os.Stat(osPath)
+	if err != nil || !info.IsDir() {
+		_ = f.serveStatus(w, r, http.StatusNotFound)
+		return
+	}
+
+	id := r.URL.Query().Get(tusKey)
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		err = f.tusCreate(w, r, osPath)
+	case r.Method == http.MethodHead && id != "":
+		err = f.tusHead(w, r, id)
+	case r.Method == http.MethodPatch && id != "":
+		err = f.tusPatch(w, r, osPath, id)
+	case r.Method == http.MethodDelete && id != "":
+		err = f.tusTerminate(w, r, id)
+	default:
+		_ = f.serveStatus(w, r, http.StatusMethodNotAllowed)
+	}
+	if err != nil {
+		log.Println("tus:", err)
+	}
+}
+
+func (f *FileHandler) tusCreate(w http.ResponseWriter, r *http.Request, osPath string) error {
+	length, err := strconv.ParseInt(r.Header.Get(tusUploadLength), 10, 64)
+	if err != nil || length < 0 {
+		return f.serveStatus(w, r, http.StatusBadRequest)
+	}
+	if f.maxUploadSize > 0 && length > f.maxUploadSize {
+		f.serveTooLarge(w, r, &http.MaxBytesError{Limit: f.maxUploadSize})
+		return nil
+	}
+	meta := parseTusMetadata(r.Header.Get(tusUploadMetadata))
+	name := meta["filename"]
+	if name == "" {
+		name = meta["name"]
+	}
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == osPathSeparator || name == "." {
+		return f.serveStatus(w, r, http.StatusBadRequest)
+	}
+	relDir, err := filepath.Rel(f.path, osPath)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(filepath.Join(osPath, name)); err == nil && f.conflict == conflictReject {
+		return f.serveStatus(w, r, http.StatusConflict)
+	}
+	if err := f.checkUpload(r, filepath.Join(osPath, name), length); err != nil {
+		f.serveTooLarge(w, r, err)
+		return err
+	}
+
+	if err := os.MkdirAll(f.tusStaging(), 0700); err != nil {
+		_ = f.serveStatus(w, r, http.StatusInternalServerError)
+		return err
+	}
+	f.tusCleanup()
+	id, err := newID()
+	if err != nil {
+		_ = f.serveStatus(w, r, http.StatusInternalServerError)
+		return err
+	}
+	dataPath, infoPath := f.tusPaths(id)
+	upload := tusUpload{
+		Route:    f.route,
+		Dir:      relDir,
+		Filename: name,
+		Length:   length,
+		Created:  time.Now(),
+	}
+	b, err := json.Marshal(upload)
+	if err == nil {
+		err = os.WriteFile(infoPath, b, 0600)
+	}
+	if err == nil {
+		err = os.WriteFile(dataPath, nil, uploadMode)
+	}
+	if err != nil {
+		_ = f.serveStatus(w, r, http.StatusInternalServerError)
+		return err
+	}
+	log.Printf("tus: created upload %s for %q (%d bytes)", id, filepath.Join(osPath, name), length)
+
+	if length == 0 {
+		if err := f.tusFinish(r, id, upload); errors.Is(err, errExists) {
+			_ = f.serveStatus(w, r, http.StatusConflict)
+			return err
+		} else if err != nil {
+			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+			return err
+		}
+	}
+	u := *r.URL
+	q := u.Query()
+	q.Set(tusKey, id)
+	u.RawQuery = q.Encode()
+	w.Header().Set("Location", u.String())
+	w.Header().Set(tusUploadOffset, "0")
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// tusLoad returns the upload and its current offset if it belongs to this route.
+func (f *FileHandler) tusLoad(id string) (upload tusUpload, offset int64, err error) {
+	if _, err := hex.DecodeString(id); err != nil {
+		return upload, 0, os.ErrNotExist
+	}
+	dataPath, infoPath := f.tusPaths(id)
+	b, err := os.ReadFile(infoPath)
+	if err != nil {
+		return upload, 0, err
+	}
+	if err := json.Unmarshal(b, &upload); err != nil {
+		return upload, 0, err
+	}
+	if upload.Route != f.route {
+		return upload, 0, os.ErrNotExist
+	}
+	info, err := os.Stat(dataPath)
+	if err != nil {
+		return upload, 0, err
+	}
+	return upload, info.Size(), nil
+}
+
+func (f *FileHandler) tusHead(w http.ResponseWriter, r *http.Request, id string) error {
+	upload, offset, err := f.tusLoad(id)
+	if err != nil {
+		return f.serveStatus(w, r, http.StatusNotFound)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(tusUploadOffset, strconv.FormatInt(offset, 10))
+	w.Header().Set(tusUploadLength, strconv.FormatInt(upload.Length, 10))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (f *FileHandler) tusPatch(w http.ResponseWriter, r *http.Request, osPath string, id string) error {
+	if r.Header.Get("Content-Type") != tusOffsetType {
+		return f.serveStatus(w, r, http.StatusUnsupportedMediaType)
+	}
+	lock, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := lock.(*sync.Mutex)
+	if !mu.TryLock() {
+		return f.serveStatus(w, r, http.StatusLocked)
+	}
+	defer mu.Unlock()
+
+	upload, offset, err := f.tusLoad(id)
+	if err != nil {
+		return f.serveStatus(w, r, http.StatusNotFound)
+	}
+	clientOffset, err := strconv.ParseInt(r.Header.Get(tusUploadOffset), 10, 64)
+	if err != nil {
+		return f.serveStatus(w, r, http.StatusBadRequest)
+	}
+	if clientOffset != offset {
+		return f.serveStatus(w, r, http.StatusConflict)
+	}
+
+	dataPath, _ := f.tusPaths(id)
+	out, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_APPEND, uploadMode)
+	if err != nil {
+		_ = f.serveStatus(w, r, http.StatusInternalServerError)
+		return err
+	}
+	// keep what arrived even if the connection drops, that is the point of tus
+	n, copyErr := io.Copy(out, io.LimitReader(r.Body, upload.Length-offset))
+	if err := out.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	offset += n
+	if copyErr != nil {
+		_ = f.serveStatus(w, r, http.StatusInternalServerError)
+		return copyErr
+	}
+
+	if offset == upload.Length {
+		if err := f.tusFinish(r, id, upload); errors.Is(err, errExists) {
+			_ = f.serveStatus(w, r, http.StatusConflict)
+			return err
+		} else if err != nil {
+			_ = f.serveStatus(w, r, http.StatusInternalServerError)
+			return err
+		}
+		log.Printf("tus: finished upload %s to %q", id, filepath.Join(osPath, upload.Filename))
+	}
+	w.Header().Set(tusUploadOffset, strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// tusFinish moves the completed data into the target directory. If it
+// cannot be placed, the data goes back to the staging folder, so the
+// upload stays complete and the next PATCH tries again.
+func (f *FileHandler) tusFinish(r *http.Request, id string, upload tusUpload) error {
+	dataPath, infoPath := f.tusPaths(id)
+	target := filepath.Join(f.path, upload.Dir, upload.Filename)
+	charge := f.quotaCharge(r, target)
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+upload.Filename+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("move upload %s: %w", id, err)
+	}
+	tmp.Close()
+	if err := moveFile(dataPath, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("move upload %s: %w", id, err)
+	}
+	saved, err := f.place(tmp.Name(), target)
+	if err != nil {
+		if moveErr := moveFile(tmp.Name(), dataPath); moveErr != nil {
+			// without its data the upload is gone
+			os.Remove(tmp.Name())
+			os.Remove(infoPath)
+			tusLocks.Delete(id)
+		}
+		return fmt.Errorf("move upload %s: %w", id, err)
+	}
+	f.recordUpload(charge, saved, upload.Length)
+	tusLocks.Delete(id)
+	return os.Remove(infoPath)
+}
+
+func (f *FileHandler) tusTerminate(w http.ResponseWriter, r *http.Request, id string) error {
+	if _, _, err := f.tusLoad(id); err != nil {
+		return f.serveStatus(w, r, http.StatusNotFound)
+	}
+	dataPath, infoPath := f.tusPaths(id)
+	_ = os.Remove(dataPath)
+	_ = os.Remove(infoPath)
+	tusLocks.Delete(id)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// tusCleanup removes uploads that have not been finished in time.
+func (f *FileHandler) tusCleanup() {
+	entries, err := os.ReadDir(f.tusStaging())
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < tusUploadExpiration {
+			continue
+		}
+		dataPath, infoPath := f.tusPaths(entry.Name())
+		_ = os.Remove(dataPath)
+		_ = os.Remove(infoPath)
+		tusLocks.Delete(entry.Name())
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// uploadMode is the mode of uploaded files, however they arrive.
+const uploadMode os.FileMode = 0600
+
+var (
+	errForbidden   = errors.New("permission denied")
+	errInvalidPath = errors.New("invalid path")
+)
+
+// uploadPath returns the relative path of an uploaded file. Browsers send
+// the path below the chosen folder as filename for folder uploads, which
+// multipart.Part.FileName strips, so Content-Disposition is parsed here.
+func uploadPath(part *multipart.Part) (string, error) {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidPath, err)
+	}
+	return relPath(params["filename"])
+}
+
+// relPath cleans a relative path with slashes or backslashes. Absolute
+// paths and paths that leave their folder are rejected.
+func relPath(name string) (string, error) {
+	clean := strings.ReplaceAll(name, `\`, "/")
+	if clean == "" || strings.HasPrefix(clean, "/") {
+		return "", fmt.Errorf("%w: %q", errInvalidPath, name)
+	}
+	for _, elem := range strings.Split(clean, "/") {
+		if elem == ".." || strings.ContainsRune(elem, 0) {
+			return "", fmt.Errorf("%w: %q", errInvalidPath, name)
+		}
+	}
+	clean = path.Clean(clean)
+	if clean == "." {
+		return "", fmt.Errorf("%w: %q", errInvalidPath, name)
+	}
+	return clean, nil
+}
+
+// uploadDir creates the folders of the relative path relDir below osPath
+// and returns the last one. Existing symbolic links are not followed, so the
+// folders cannot end up outside of the route.
+func (f *FileHandler) uploadDir(r *http.Request, osPath, relDir string) (string, error) {
+	dir := osPath
+	elems := strings.Split(relDir, "/")
+	if relDir == "." {
+		elems = nil
+	}
+	for _, elem := range elems {
+		dir = filepath.Join(dir, elem)
+		if !within(f.path, dir) {
+			return "", errInvalidPath
+		}
+		info, err := os.Lstat(dir)
+		switch {
+		case err == nil && info.IsDir():
+			continue
+		case err == nil:
+			return "", fmt.Errorf("%w: %q is not a folder", errInvalidPath, elem)
+		case !os.IsNotExist(err):
+			return "", err
+		case !f.permissions(r, dir).create:
+			return "", errForbidden
+		}
+		if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+			return "", err
+		}
+	}
+	if !f.permissions(r, dir).upload {
+		return "", errForbidden
+	}
+	return dir, nil
+}
+
+// saveUpload writes an uploaded file below osPath, creating the folders
+// of its relative path. The file is only moved into place when its
+// checksums match want and those in the headers of the part.
+func (f *FileHandler) saveUpload(r *http.Request, osPath string, part *multipart.Part, want digests) (uploadedFile, error) {
+	rel, err := uploadPath(part)
+	if err != nil {
+		return uploadedFile{}, err
+	}
+	partDigests, err := parseDigests(part.Header)
+	if err != nil {
+		return uploadedFile{}, err
+	}
+	if want, err = want.merge(partDigests); err != nil {
+		return uploadedFile{}, err
+	}
+	dir, err := f.uploadDir(r, osPath, path.Dir(rel))
+	if err != nil {
+		return uploadedFile{}, err
+	}
+	dst := filepath.Join(dir, path.Base(rel))
+	body, charge, err := f.limitUpload(r, dst, part)
+	if err != nil {
+		return uploadedFile{}, err
+	}
+	defer f.releaseUpload(charge)
+	h := newHasher()
+	tmp, n, err := writeTemp(dst, uploadMode, io.TeeReader(body, h))
+	if err != nil {
+		return uploadedFile{}, err
+	}
+	if err := h.verify(want); err != nil {
+		os.Remove(tmp)
+		return uploadedFile{}, fmt.Errorf("%w (%s)", err, rel)
+	}
+	saved, err := f.place(tmp, dst)
+	if err != nil {
+		os.Remove(tmp)
+		return uploadedFile{}, err
+	}
+	f.recordUpload(charge, saved, n)
+	f.cacheUploadChecksums(saved, h)
+	return uploadedFile{
+		Path:   path.Join(path.Dir(rel), filepath.Base(saved)),
+		Size:   n,
+		MD5:    hex.EncodeToString(h.sum(digestMD5)),
+		SHA256: hex.EncodeToString(h.sum(digestSHA256)),
+	}, nil
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+// davFS is webdav.Dir that hides hidden files from collection listings
+// when the route does not allow them, same as serveDir does.
+type davFS struct {
+	webdav.Dir
+	noAllowHidden bool
+}
+
+func (d davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if put, ok := ctx.Value(davPutKey{}).(*davPut); ok && flag&os.O_TRUNC != 0 {
+		tmp, err := createTemp(put.dst)
+		if err != nil {
+			return nil, err
+		}
+		return &davTempFile{File: tmp, tmp: tmp, put: put}, nil
+	}
+	file, err := d.Dir.OpenFile(ctx, name, flag, perm)
+	if err != nil || !d.noAllowHidden {
+		return file, err
+	}
+	osPath := filepath.Join(string(d.Dir), filepath.FromSlash(path.Clean("/"+name)))
+	return davFile{File: file, path: osPath}, nil
+}
+
+type davFile struct {
+	webdav.File
+	path string
+}
+
+func (d davFile) Readdir(count int) ([]os.FileInfo, error) {
+	files, err := d.File.Readdir(count)
+	out := files[:0]
+	for _, info := range files {
+		if !isHidden(filepath.Join(d.path, info.Name())) {
+			out = append(out, info)
+		}
+	}
+	return out, err
+}
+
+func newWebDAVHandler(route, osPath string, noAllowHidden bool) *webdav.Handler {
+	return &webdav.Handler{
+		Prefix:     route,
+		FileSystem: davFS{Dir: webdav.Dir(osPath), noAllowHidden: noAllowHidden},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("webdav %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+}
+
+// isWebDAVMethod reports whether the request must be answered by the WebDAV handler.
+func isWebDAVMethod(method string) bool {
+	switch method {
+	case http.MethodOptions, http.MethodPut,
+		"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK":
+		return true
+	}
+	return false
+}
+
+// webDAVAllowed maps a WebDAV method to the permissions of the request.
+// COPY and MOVE also need a permission at their destination, and delete
+// there when they replace what is at the destination.
+func (f *FileHandler) webDAVAllowed(r *http.Request, perms permissions) bool {
+	switch r.Method {
+	case http.MethodPut, "PROPPATCH":
+		return perms.upload
+	case "MKCOL":
+		return perms.create
+	case "COPY", "MOVE":
+		dst, ok := f.davDestination(r)
+		if !ok {
+			return false
+		}
+		dstPerms := f.permissions(r, dst)
+		if davOverwrites(r, dst) && !dstPerms.delete {
+			return false
+		}
+		if r.Method == "COPY" {
+			return dstPerms.upload
+		}
+		return perms.rename && dstPerms.rename
+	case "LOCK", "UNLOCK":
+		return perms.upload || perms.create || perms.delete || perms.rename
+	}
+	return true
+}
+
+// davDestination returns the path the Destination header of a COPY or MOVE
+// points to.
+func (f *FileHandler) davDestination(r *http.Request) (string, bool) {
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil {
+		return "", false
+	}
+	return f.osPath(u.Path), true
+}
+
+// davOverwrites reports whether a COPY or MOVE to dst replaces a file or
+// folder. The WebDAV handler removes it first unless the request has
+// "Overwrite: F".
+func davOverwrites(r *http.Request, dst string) bool {
+	if strings.EqualFold(strings.TrimSpace(r.Header.Get("Overwrite")), "F") {
+		return false
+	}
+	_, err := os.Lstat(dst)
+	return err == nil
+}
+
+func (f *FileHandler) serveWebDAV(w http.ResponseWriter, r *http.Request, perms permissions) {
+	if !f.webDAVAllowed(r, perms) {
+		_ = f.serveStatus(w, r, http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodPut && f.maxUploadSize > 0 {
+		if r.ContentLength > f.maxUploadSize {
+			f.serveTooLarge(w, r, &http.MaxBytesError{Limit: f.maxUploadSize})
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, f.maxUploadSize)
+	}
+	if r.Method == http.MethodPut {
+		f.serveWebDAVPut(w, r)
+		return
+	}
+	if r.Method == "COPY" {
+		// a source that cannot be read is left to the WebDAV handler
+		if size, files, err := treeSize(f.osPath(r.URL.Path)); err == nil {
+			if err := f.checkCopy(r, size, files); err != nil {
+				f.serveTooLarge(w, r, err)
+				return
+			}
+		}
+	}
+	f.webdav.ServeHTTP(w, r)
+}
+
+// davPutKey is the context key of the davPut of a PUT request.
+type davPutKey struct{}
+
+// davPut is a WebDAV PUT in progress. The WebDAV handler writes the body
+// to a temp file, which is moved into place once the whole body arrived
+// within the limits of the route, so a failed PUT leaves the existing file
+// alone.
+type davPut struct {
+	f      *FileHandler
+	dst    string
+	body   *putBody
+	limit  *quotaReader
+	h      *hasher
+	want   digests
+	charge quotaCharge
+	// saved is where the file ended up by the conflict policy of the route
+	saved string
+	// err is why the upload was refused, to be answered instead of the
+	// response of the WebDAV handler
+	err error
+}
+
+// putBody remembers how reading a PUT body ended.
+type putBody struct {
+	io.Reader
+	io.Closer
+	err error
+}
+
+func (b *putBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err != nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// finish moves the temp file tmp with the body of n bytes into place, if
+// the body arrived completely, within the limits and with the checksums
+// of the digest headers.
+func (p *davPut) finish(tmp string, n int64) error {
+	err := p.body.err
+	switch {
+	case p.limit != nil && p.limit.exceeded:
+		err = p.limit.err
+	case err == nil:
+		err = io.ErrUnexpectedEOF
+	case err == io.EOF:
+		if err = p.h.verify(p.want); err == nil {
+			p.saved, err = p.f.place(tmp, p.dst)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		p.err = err
+		return err
+	}
+	p.f.recordUpload(p.charge, p.saved, n)
+	p.f.cacheUploadChecksums(p.saved, p.h)
+	return nil
+}
+
+// davTempFile is the temp file a PUT body is written to and hashed on the
+// way. It embeds webdav.File, not *os.File, so io.Copy goes through Write.
+type davTempFile struct {
+	webdav.File
+	tmp *os.File
+	put *davPut
+	n   int64
+}
+
+func (t *davTempFile) Write(b []byte) (int, error) {
+	n, err := t.tmp.Write(b)
+	t.put.h.Write(b[:n])
+	t.n += int64(n)
+	return n, err
+}
+
+func (t *davTempFile) Close() error {
+	err := t.tmp.Chmod(uploadMode)
+	if cerr := t.tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(t.tmp.Name())
+		t.put.err = err
+		return err
+	}
+	return t.put.finish(t.tmp.Name(), t.n)
+}
+
+// putWriter drops the response of the WebDAV handler to a PUT that was
+// refused, to be answered by serveWebDAVPut instead. Successful responses
+// carry the SHA-256 of what was written as Repr-Digest, and the URL of the
+// file as Location when it was saved under another name.
+type putWriter struct {
+	http.ResponseWriter
+	put     *davPut
+	url     string
+	dropped bool
+}
+
+func (p *putWriter) WriteHeader(status int) {
+	if p.put.err != nil {
+		p.dropped = true
+		return
+	}
+	if status < 300 {
+		p.Header().Set("Repr-Digest", p.put.h.reprDigest())
+		if p.put.saved != "" && p.put.saved != p.put.dst {
+			u := url.URL{Path: path.Join(path.Dir(p.url), filepath.Base(p.put.saved))}
+			p.Header().Set("Location", u.String())
+		}
+	}
+	p.ResponseWriter.WriteHeader(status)
+}
+
+func (p *putWriter) Write(b []byte) (int, error) {
+	if p.dropped {
+		return len(b), nil
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+// serveWebDAVPut hands a PUT to the WebDAV handler with the body limited
+// by the quotas. The body goes to a temp file first, which is checked
+// against the digest headers, see davPut.
+func (f *FileHandler) serveWebDAVPut(w http.ResponseWriter, r *http.Request) {
+	dst := f.osPath(r.URL.Path)
+	want, err := parseDigests(textproto.MIMEHeader(r.Header))
+	if err != nil {
+		serveDigestError(w, err)
+		return
+	}
+	if r.ContentLength > 0 {
+		if err := f.checkUpload(r, dst, r.ContentLength); err != nil {
+			f.serveTooLarge(w, r, err)
+			return
+		}
+	}
+	body, charge, err := f.limitUpload(r, dst, r.Body)
+	if err != nil {
+		f.serveTooLarge(w, r, err)
+		return
+	}
+	defer f.releaseUpload(charge)
+	put := &davPut{f: f, dst: dst, h: newHasher(), want: want, charge: charge}
+	put.limit, _ = body.(*quotaReader)
+	put.body = &putBody{Reader: body, Closer: r.Body}
+	r.Body = put.body
+	pw := &putWriter{ResponseWriter: w, put: put, url: r.URL.Path}
+	f.webdav.ServeHTTP(pw, r.WithContext(context.WithValue(r.Context(), davPutKey{}, put)))
+	if !pw.dropped {
+		return
+	}
+	switch err := put.err; {
+	case isTooLarge(err):
+		f.serveTooLarge(w, r, err)
+	case isDigestError(err):
+		serveDigestError(w, err)
+	case errors.Is(err, errExists):
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte(err.Error()))
+	case errors.Is(err, errInvalidPath):
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+	default:
+		log.Println("webdav PUT:", err)
+		_ = f.serveStatus(w, r, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultLevel compresses with the default level of each format.
+const DefaultLevel = -1
+
+// ArchiveWriter writes files into an archive.
+type ArchiveWriter interface {
+	// Add adds the folder or regular file at path, described by info, as
+	// name, a slash separated path below the root of the archive.
+	Add(name, path string, info os.FileInfo) error
+	// Close finishes the archive. It does not close the writer below.
+	Close() error
+}
+
+// ArchiveFormat is a format folders can be downloaded in.
+type ArchiveFormat struct {
+	// Name is the value of ?archive= and the extension of the archive.
+	Name        string
+	ContentType string
+	// New returns a writer of the format to w. The level goes from 0 (no
+	// compression) to 9 (smallest), or is DefaultLevel. Formats without
+	// levels ignore it.
+	New func(w io.Writer, level int) (ArchiveWriter, error)
+}
+
+var archiveFormats []ArchiveFormat
+
+// RegisterArchiveFormat makes a format available for downloads. A format
+// with the same name is replaced.
+func RegisterArchiveFormat(format ArchiveFormat) {
+	for i := range archiveFormats {
+		if archiveFormats[i].Name == format.Name {
+			archiveFormats[i] = format
+			return
+		}
+	}
+	archiveFormats = append(archiveFormats, format)
+}
+
+// LookupArchiveFormat returns the format called name.
+func LookupArchiveFormat(name string) (ArchiveFormat, bool) {
+	for _, format := range archiveFormats {
+		if format.Name == name {
+			return format, true
+		}
+	}
+	return ArchiveFormat{}, false
+}
+
+// ArchiveFormats returns the names of the formats in the order they were
+// registered.
+func ArchiveFormats() []string {
+	names := make([]string, 0, len(archiveFormats))
+	for _, format := range archiveFormats {
+		names = append(names, format.Name)
+	}
+	return names
+}
+
+func init() {
+	RegisterArchiveFormat(ArchiveFormat{Name: "zip", ContentType: "application/zip", New: newZipWriter})
+	RegisterArchiveFormat(ArchiveFormat{Name: "tar", ContentType: "application/x-tar", New: newTarWriter})
+	RegisterArchiveFormat(ArchiveFormat{Name: "tar.gz", ContentType: "application/x-tar+gzip", New: newTarGzWriter})
+	RegisterArchiveFormat(ArchiveFormat{Name: "tar.zst", ContentType: "application/zstd", New: newTarZstWriter})
+	RegisterArchiveFormat(ArchiveFormat{Name: "tar.xz", ContentType: "application/x-xz", New: newTarXzWriter})
+}
+
+// ParseLevel parses a compression level from 0 to 9, "" for DefaultLevel.
+func ParseLevel(s string) (int, error) {
+	if s == "" {
+		return DefaultLevel, nil
+	}
+	level, err := strconv.Atoi(s)
+	if err != nil || level < 0 || level > 9 {
+		return 0, fmt.Errorf("invalid compression level %q, want 0 (none) to 9", s)
+	}
+	return level, nil
+}
+
+// WriteArchive writes the files below path, or the given entries of path
+// with everything below them, as an archive of format. Symbolic links are
+// archived as the files they point to; links to folders and other special
+// files are left out, as are the files and folders skip reports.
+func WriteArchive(w io.Writer, format ArchiveFormat, path string, files []string, level int, skip func(path string) bool) error {
+	aw, err := format.New(w, level)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := aw.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	basePath := path
+	addFile := func(path string, stat os.FileInfo) error {
+		name, err := filepath.Rel(basePath, path)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		if skip != nil && skip(path) {
+			if stat.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if stat.Mode()&os.ModeSymlink != 0 {
+			if stat, err = os.Stat(path); err != nil || stat.IsDir() {
+				return err
+			}
+		}
+		if !stat.IsDir() && !stat.Mode().IsRegular() {
+			return nil
+		}
+		return aw.Add(filepath.ToSlash(name), path, stat)
+	}
+
+	if len(files) > 0 {
+		for _, item := range files {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			fPath := path + string(filepath.Separator) + item
+			info, err := os.Lstat(fPath)
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				err = filepath.Walk(fPath, func(path string, info os.FileInfo, err error) error {
+					if err != nil {
+						return err
+					}
+					return addFile(path, info)
+				})
+				if err != nil {
+					return err
+				}
+			} else {
+				err = addFile(fPath, info)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return addFile(path, info)
+	})
+}
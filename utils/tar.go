@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// tarWriter writes tar archives, compressed by comp if it is set. Entries
+// have their modification time and permissions, and folders get entries
+// of their own.
+type tarWriter struct {
+	tw   *tar.Writer
+	comp io.WriteCloser
+}
+
+func newTarWriter(w io.Writer, level int) (ArchiveWriter, error) {
+	return &tarWriter{tw: tar.NewWriter(w)}, nil
+}
+
+func newTarGzWriter(w io.Writer, level int) (ArchiveWriter, error) {
+	comp, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	return &tarWriter{tw: tar.NewWriter(comp), comp: comp}, nil
+}
+
+// newTarZstWriter maps the levels 0 to 9 onto those of zstd, 0 to 2 being
+// the fastest and 6 to 9 the better compression.
+func newTarZstWriter(w io.Writer, level int) (ArchiveWriter, error) {
+	encLevel := zstd.SpeedDefault
+	if level != DefaultLevel {
+		encLevel = zstd.EncoderLevelFromZstd(level)
+	}
+	comp, err := zstd.NewWriter(w, zstd.WithEncoderLevel(encLevel), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &tarWriter{tw: tar.NewWriter(comp), comp: comp}, nil
+}
+
+// newTarXzWriter ignores the level, xz has none to choose from here.
+func newTarXzWriter(w io.Writer, level int) (ArchiveWriter, error) {
+	comp, err := xz.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	return &tarWriter{tw: tar.NewWriter(comp), comp: comp}, nil
+}
+
+func (t *tarWriter) Add(name, path string, info os.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+		return t.tw.WriteHeader(header)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := t.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	// the size is written already, the file must not grow
+	if _, err := io.CopyN(t.tw, file, info.Size()); err != nil {
+		return err
+	}
+	return t.tw.Flush()
+}
+
+func (t *tarWriter) Close() error {
+	err := t.tw.Close()
+	if t.comp != nil {
+		if cerr := t.comp.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
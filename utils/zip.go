@@ -2,83 +2,125 @@ package utils
 
 import (
 	zipper "archive/zip"
-	"fmt"
+	"compress/flate"
+	"hash/crc32"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"unicode/utf8"
 )
 
-func Zip(w io.Writer, path string, files []string) error {
-	basePath := path
-	addFile := func(w *zipper.Writer, path string, stat os.FileInfo) error {
-		if stat.IsDir() {
-			return nil
-		}
-		file, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-		path, err = filepath.Rel(basePath, path)
-		if err != nil {
-			return err
-		}
-		zw, err := w.Create(path)
-		if err != nil {
-			return err
-		}
-		if _, err := io.Copy(zw, file); err != nil {
-			return err
-		}
-		return w.Flush()
+// zipStreamMax is the size from which files are read twice, once for
+// their CRC-32, so their local header can carry Zip64 sizes instead of
+// leaving them to a data descriptor that not every reader understands.
+const zipStreamMax = 1<<32 - 1
+
+// compressedExts are file types that are compressed already, deflating
+// them again costs CPU and saves nothing, so they are stored.
+var compressedExts = map[string]bool{
+	".7z": true, ".apk": true, ".avi": true, ".avif": true, ".br": true,
+	".bz2": true, ".docx": true, ".epub": true, ".flac": true, ".gif": true,
+	".gz": true, ".heic": true, ".jar": true, ".jpeg": true, ".jpg": true,
+	".lz4": true, ".m4a": true, ".m4v": true, ".mkv": true, ".mov": true,
+	".mp3": true, ".mp4": true, ".odp": true, ".ods": true, ".odt": true,
+	".ogg": true, ".opus": true, ".png": true, ".pptx": true, ".rar": true,
+	".tgz": true, ".txz": true, ".webm": true, ".webp": true, ".whl": true,
+	".xlsx": true, ".xz": true, ".zip": true, ".zst": true,
+}
+
+// IsCompressed reports whether name has the extension of a file type
+// that is compressed already.
+func IsCompressed(name string) bool {
+	return compressedExts[strings.ToLower(filepath.Ext(name))]
+}
+
+// fileCRC32 reads the file at path for its CRC-32.
+func fileCRC32(path string) (uint32, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
 	}
-	wZip := zipper.NewWriter(w)
-	defer func() {
-		if err := wZip.Close(); err != nil {
-			log.Println(err)
-		}
-	}()
+	defer file.Close()
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, file); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
 
-	if len(files) > 0 {
-		for _, item := range files {
-			item = strings.TrimSpace(item)
-			if item == "" {
-				continue
-			}
-			fPath := path + string(filepath.Separator) + item
-			info, err := os.Lstat(fPath)
-			if err != nil {
-				fmt.Println(err)
-				return err
-			}
-			if info.IsDir() {
-				err = filepath.Walk(fPath, func(path string, info os.FileInfo, err error) error {
-					if err != nil {
-						return err
-					}
-					return addFile(wZip, path, info)
-				})
-				if err != nil {
-					fmt.Println(err)
-					return err
-				}
-			} else {
-				err = addFile(wZip, fPath, info)
-				if err != nil {
-					fmt.Println(err)
-					return err
-				}
-			}
-		}
-		return nil
+// zipWriter writes zip archives. Every entry has its modification time
+// and permissions, and folders get entries of their own, so empty ones are
+// kept. Files are deflated, except those that are compressed already;
+// level 0 stores all of them.
+type zipWriter struct {
+	zw    *zipper.Writer
+	level int
+}
+
+func newZipWriter(w io.Writer, level int) (ArchiveWriter, error) {
+	zw := zipper.NewWriter(w)
+	if level != DefaultLevel && level != flate.NoCompression {
+		zw.RegisterCompressor(zipper.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+	}
+	return &zipWriter{zw: zw, level: level}, nil
+}
+
+func (z *zipWriter) Add(name, path string, info os.FileInfo) error {
+	header, err := zipper.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+		_, err := z.zw.CreateHeader(header)
+		return err
+	}
+	header.Method = zipper.Deflate
+	if z.level == flate.NoCompression || IsCompressed(name) {
+		header.Method = zipper.Store
 	}
 
-	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var w io.Writer
+	raw := info.Size() >= zipStreamMax
+	if raw {
+		header.Method = zipper.Store
+		if header.CRC32, err = fileCRC32(path); err != nil {
 			return err
 		}
-		return addFile(wZip, path, info)
-	})
+		header.CompressedSize64 = uint64(info.Size())
+		header.UncompressedSize64 = uint64(info.Size())
+		if strings.IndexFunc(header.Name, func(r rune) bool { return r >= utf8.RuneSelf }) >= 0 {
+			// CreateRaw leaves the UTF-8 flag to the caller
+			header.Flags |= 0x800
+		}
+		w, err = z.zw.CreateRaw(header)
+	} else {
+		w, err = z.zw.CreateHeader(header)
+	}
+	if err != nil {
+		return err
+	}
+	if raw {
+		// the sizes are written already, the file must not grow
+		_, err = io.CopyN(w, file, info.Size())
+	} else {
+		_, err = io.Copy(w, file)
+	}
+	if err != nil {
+		return err
+	}
+	return z.zw.Flush()
+}
+
+func (z *zipWriter) Close() error {
+	return z.zw.Close()
 }